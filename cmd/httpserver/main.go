@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"io"
@@ -11,17 +12,30 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"httpfromtcp/internal/headers"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/router"
 	"httpfromtcp/internal/server"
 )
 
-const port = 42069
+const (
+	port            = 42069
+	shutdownTimeout = 10 * time.Second
+)
 
 func main() {
-	server, err := server.Serve(port, handler)
+	router := router.NewRouter()
+	router.Handle("GET", "/httpbin/{path...}", proxyHandler)
+	router.Handle("", "/yourproblem", pageHandler(response.StatusBadRequest))
+	router.Handle("", "/myproblem", pageHandler(response.StatusInternalServerError))
+	router.Handle("", "/{path...}", pageHandler(response.StatusOK))
+
+	server, err := server.ServeWithOptions(port, router.ServeRequest, server.Options{
+		AccessLog: server.NewAccessLogger(os.Stdout, server.CombinedLogFormat),
+	})
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
@@ -31,60 +45,40 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
-	log.Println("Server gracefully stopped")
-}
 
-func handler(w *response.Writer, req *request.Request) {
-
-	if strings.HasPrefix(req.RequestLine.RequestTarget, "/httpbin/") {
-		proxyHandler(w, req)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error waiting for connections to finish: %v", err)
 		return
 	}
+	log.Println("Server gracefully stopped")
+}
 
-	path := strings.TrimPrefix(req.RequestLine.RequestTarget, "/")
-
-	headers := response.GetDefaultHeaders(0)
-	headers["content-type"] = "text/html"
-
-	switch path {
-	case "yourproblem":
-		body := bodyBytes(400)
-		w.WriteStatusLine(response.StatusNotFound)
-		headers["content-length"] = strconv.Itoa(len(body))
-
-		w.WriteHeaders(headers)
-		w.WriteBody(body)
-	case "myproblem":
-		body := bodyBytes(500)
-		w.WriteStatusLine(response.StatusServerError)
-		headers["content-length"] = strconv.Itoa(len(body))
-
-		w.WriteHeaders(headers)
-		w.WriteBody(body)
-	default:
-		body := bodyBytes(200)
-		w.WriteStatusLine(response.StatusOK)
-		headers["content-length"] = strconv.Itoa(len(body))
-
-		w.WriteHeaders(headers)
-		w.WriteBody(body)
-
+func pageHandler(statusCode response.StatusCode) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.Header().Set("content-type", "text/html")
+		w.WriteHeader(statusCode)
+		w.Write(bodyBytes(int(statusCode)))
 	}
 }
 
 func proxyHandler(w *response.Writer, req *request.Request) {
-	h := headers.Headers{
-		"Content-Type":      "text/plain",
-		"Transfer-Encoding": "chunked",
-		"Trailer":           "X-Content-SHA256, X-Content-Length",
-	}
+	h := headers.NewHeaders()
+	h.Set("Content-Type", "text/plain")
+	h.Set("Transfer-Encoding", "chunked")
+	w.DeclareTrailers("X-Content-SHA256", "X-Content-Length")
 
 	buffer := make([]byte, 32)
-	target := strings.TrimPrefix(req.RequestLine.RequestTarget, "/httpbin")
+	target := strings.TrimPrefix(req.URL.RawPath, "/httpbin")
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
 
 	resp, err := http.Get("https://httpbin.org" + target)
 	if err != nil {
 		w.WriteError(err)
+		return
 	}
 	defer resp.Body.Close()
 
@@ -113,17 +107,18 @@ func proxyHandler(w *response.Writer, req *request.Request) {
 			break
 		}
 		if err != nil {
-			w.WriteError(err)
+			// the response is already started, the client gets what was read so far
+			log.Printf("Error reading proxied response: %v", err)
+			return
 		}
 	}
 	w.WriteChunkedBodyDone()
 
 	hash := sha256.Sum256(body)
 
-	trailers := headers.Headers{
-		"X-Content-SHA256": fmt.Sprintf("%x", hash),
-		"X-Content-Length": strconv.Itoa(bodyLength),
-	}
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Content-SHA256", fmt.Sprintf("%x", hash))
+	trailers.Set("X-Content-Length", strconv.Itoa(bodyLength))
 
 	w.WriteTrailers(trailers)
 	w.WriteDone()
@@ -1,15 +1,33 @@
 package headers
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
-type Headers map[string]string
+var (
+	ErrMalformedFieldLine = errors.New("malformed header field line")
+	ErrInvalidFieldName   = errors.New("invalid header field name")
+	ErrInvalidFieldValue  = errors.New("invalid header field value")
+)
+
+// Headers is an ordered list of header fields. Names are matched without
+// regard to case, and a name may appear more than once. Each field remembers
+// the spelling of its name: parsed fields keep what was on the wire, fields
+// added with Add or Set are written in canonical form.
+type Headers struct {
+	fields []field
+}
+
+type field struct {
+	name  string
+	value string
+}
 
 const validChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!#$%&'*+-.^_`|~"
 
-func (h Headers) Parse(data []byte) (n int, done bool, err error) {
+func (h *Headers) Parse(data []byte) (n int, done bool, err error) {
 	dataString := string(data)
 	if !strings.Contains(dataString, "\r\n") {
 		return 0, false, nil
@@ -20,38 +38,172 @@ func (h Headers) Parse(data []byte) (n int, done bool, err error) {
 		return 0, true, nil
 	}
 
-	fields := strings.Fields(header)
-	// check if there are two parts in the header
-	if len(fields) != 2 {
-		return 0, false, fmt.Errorf("invalid header format: %s", header)
+	// leading whitespace is tolerated, the name runs up to the first colon
+	name, value, found := strings.Cut(strings.TrimLeft(header, " \t"), ":")
+	if !found {
+		return 0, false, fmt.Errorf("%w: %s", ErrMalformedFieldLine, header)
+	}
+	// no whitespace is allowed in the name or between it and the colon (RFC 9112 5.1)
+	if strings.ContainsAny(name, " \t") {
+		return 0, false, fmt.Errorf("%w: %s", ErrMalformedFieldLine, header)
+	}
+	if !isToken(name) {
+		return 0, false, fmt.Errorf("%w: %s", ErrInvalidFieldName, name)
+	}
+
+	fieldValue := strings.Trim(value, " \t")
+	if !isFieldValue(fieldValue) {
+		return 0, false, fmt.Errorf("%w: %q", ErrInvalidFieldValue, fieldValue)
 	}
+	h.AddRaw(name, fieldValue)
 
-	// check if the header key ends with ":"
-	if fields[0][len(fields[0])-1] != ':' {
-		return 0, false, fmt.Errorf("invalid header format: %s", header)
+	return len(header) + 2, false, nil
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
 	}
-	for _, char := range fields[0][0 : len(fields[0])-1] {
+	for _, char := range s {
 		if !strings.ContainsRune(validChars, char) {
-			return 0, false, fmt.Errorf("invalid character in header key: %s", fields[0][:len(fields[0])-1])
+			return false
 		}
 	}
-	key := strings.ToLower(fields[0][0 : len(fields[0])-1])
+	return true
+}
 
-	value, ok := h[key]
-	if ok {
-		h[key] = value + ", " + fields[1]
-	} else {
-		h[key] = fields[1]
+// isFieldValue checks a trimmed value only holds visible characters, spaces,
+// tabs and obs-text bytes, as field-value is defined in RFC 9110 5.5.
+func isFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != ' ' && c != '\t' && (c < 0x21 || c == 0x7f) {
+			return false
+		}
 	}
+	return true
+}
 
-	return len(header) + 2, false, nil
+// Get returns every value of the field joined by ", ", the way repeated list
+// fields may be combined. Fields like Set-Cookie can't be combined, use Values.
+func (h *Headers) Get(key string) (string, bool) {
+	values := h.Values(key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return strings.Join(values, ", "), true
+}
+
+// Values returns each value of the field in the order they were added.
+func (h *Headers) Values(key string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Add appends a field under the canonical form of key, keeping any existing
+// values for the same name.
+func (h *Headers) Add(key, value string) {
+	h.AddRaw(CanonicalName(key), value)
+}
+
+// AddRaw is Add without canonicalizing key, for proxies that pass names on
+// exactly as they received them.
+func (h *Headers) AddRaw(key, value string) {
+	h.fields = append(h.fields, field{name: key, value: value})
+}
+
+// Set replaces every value of the field with value under the canonical form
+// of key. The field keeps the position of its first occurrence, or is appended
+// if it is new.
+func (h *Headers) Set(key, value string) {
+	h.SetRaw(CanonicalName(key), value)
 }
 
-func (h Headers) Get(key string) (string, bool) {
-	value, ok := h[strings.ToLower(key)]
-	return value, ok
+// SetRaw is Set without canonicalizing key.
+func (h *Headers) SetRaw(key, value string) {
+	for i, f := range h.fields {
+		if strings.EqualFold(f.name, key) {
+			h.fields[i] = field{name: key, value: value}
+			h.deleteFrom(i+1, key)
+			return
+		}
+	}
+	h.AddRaw(key, value)
+}
+
+// Del removes every value of the field.
+func (h *Headers) Del(key string) {
+	h.deleteFrom(0, key)
+}
+
+func (h *Headers) deleteFrom(start int, key string) {
+	kept := h.fields[:start]
+	for _, f := range h.fields[start:] {
+		if !strings.EqualFold(f.name, key) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
+}
+
+// Range calls fn for each field in order with its canonical name, stopping
+// if fn returns false.
+func (h *Headers) Range(fn func(key, value string) bool) {
+	h.RangeRaw(func(key, value string) bool {
+		return fn(CanonicalName(key), value)
+	})
+}
+
+// RangeRaw is Range with each name spelled the way it was received or added.
+func (h *Headers) RangeRaw(fn func(key, value string) bool) {
+	for _, f := range h.fields {
+		if !fn(f.name, f.value) {
+			return
+		}
+	}
+}
+
+func (h *Headers) Len() int {
+	return len(h.fields)
+}
+
+// CanonicalName returns the Title-Case form of a field name, such as
+// "Content-Type" for "content-type". Names that aren't valid tokens are
+// returned unchanged.
+func CanonicalName(name string) string {
+	if !isToken(name) {
+		return name
+	}
+
+	canonical := []byte(name)
+	upper := true
+	for i, c := range canonical {
+		if upper && 'a' <= c && c <= 'z' {
+			canonical[i] = c - ('a' - 'A')
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			canonical[i] = c + ('a' - 'A')
+		}
+		upper = c == '-'
+	}
+	return string(canonical)
+}
+
+// HasToken reports whether a comma-separated header value such as
+// "keep-alive, close" contains token, ignoring case.
+func HasToken(value, token string) bool {
+	for _, option := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(option), token) {
+			return true
+		}
+	}
+	return false
 }
 
-func NewHeaders() Headers {
-	return make(Headers)
+func NewHeaders() *Headers {
+	return &Headers{}
 }
@@ -14,7 +14,7 @@ func TestHeaders(t *testing.T) {
 	n, done, err := headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 
@@ -24,22 +24,22 @@ func TestHeaders(t *testing.T) {
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 43, n)
 	assert.False(t, done)
 
 	// Test: Valid two headers with existing header
 	headers = NewHeaders()
-	headers["existing"] = "existingValue"
+	headers.Add("existing", "existingValue")
 	data = []byte("Host: localhost:42069\r\n Test: test\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	require.NotNil(t, headers)
-	assert.Equal(t, "localhost:42069", headers["host"])
+	assert.Equal(t, []string{"localhost:42069"}, headers.Values("host"))
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
 	n, done, err = headers.Parse(data[23:])
-	assert.Equal(t, "test", headers["test"])
+	assert.Equal(t, []string{"test"}, headers.Values("test"))
 	require.NoError(t, err)
 	require.NotNil(t, headers)
 	assert.Equal(t, 13, n)
@@ -49,7 +49,7 @@ func TestHeaders(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("       Host : localhost:42069       \r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedFieldLine)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
@@ -57,7 +57,7 @@ func TestHeaders(t *testing.T) {
 	headers = NewHeaders()
 	data = []byte("       H@st: localhost:42069       \r\n\r\n")
 	n, done, err = headers.Parse(data)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidFieldName)
 	assert.Equal(t, 0, n)
 	assert.False(t, done)
 
@@ -71,12 +71,165 @@ func TestHeaders(t *testing.T) {
 
 	// Test: Duplicate value in header
 	headers = NewHeaders()
-	headers["host"] = "localhost:69420"
+	headers.Add("host", "localhost:69420")
 	data = []byte("Host: localhost:42069\r\n\r\n")
 	n, done, err = headers.Parse(data)
 	require.NoError(t, err)
 	assert.Equal(t, 23, n)
 	assert.False(t, done)
-	assert.Equal(t, "localhost:69420, localhost:42069", headers["host"])
+	value, _ := headers.Get("host")
+	assert.Equal(t, "localhost:69420, localhost:42069", value)
+	assert.Equal(t, []string{"localhost:69420", "localhost:42069"}, headers.Values("host"))
 
 }
+
+func TestFieldLineParsing(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		key   string
+		value string
+		err   error
+	}{
+		{name: "value with spaces", line: "User-Agent: Mozilla/5.0 (X11; Linux x86_64)", key: "user-agent", value: "Mozilla/5.0 (X11; Linux x86_64)"},
+		{name: "list value", line: "Accept: text/html, */*", key: "accept", value: "text/html, */*"},
+		{name: "no space after colon", line: "Host:localhost:42069", key: "host", value: "localhost:42069"},
+		{name: "tabs around value", line: "X-Tab:\t value\twith tab \t", key: "x-tab", value: "value\twith tab"},
+		{name: "empty value", line: "X-Empty:", key: "x-empty", value: ""},
+		{name: "whitespace only value", line: "X-Empty:   ", key: "x-empty", value: ""},
+		{name: "obs-text in value", line: "X-Name: caf\xe9", key: "x-name", value: "caf\xe9"},
+		{name: "quoted value", line: `Content-Disposition: attachment; filename="a b.txt"`, key: "content-disposition", value: `attachment; filename="a b.txt"`},
+		{name: "missing colon", line: "Host localhost", err: ErrMalformedFieldLine},
+		{name: "space before colon", line: "Host : localhost", err: ErrMalformedFieldLine},
+		{name: "tab before colon", line: "Host\t: localhost", err: ErrMalformedFieldLine},
+		{name: "empty name", line: ": localhost", err: ErrInvalidFieldName},
+		{name: "invalid name character", line: "H(st): localhost", err: ErrInvalidFieldName},
+		{name: "control character in value", line: "X-Bad: a\x00b", err: ErrInvalidFieldValue},
+		{name: "delete character in value", line: "X-Bad: a\x7fb", err: ErrInvalidFieldValue},
+		{name: "bare CR in value", line: "X-Bad: a\rb", err: ErrInvalidFieldValue},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := NewHeaders()
+			n, done, err := headers.Parse([]byte(tc.line + "\r\n\r\n"))
+			assert.False(t, done)
+			if tc.err != nil {
+				require.ErrorIs(t, err, tc.err)
+				assert.Equal(t, 0, n)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, len(tc.line)+2, n)
+			value, ok := headers.Get(tc.key)
+			assert.True(t, ok)
+			assert.Equal(t, tc.value, value)
+		})
+	}
+}
+
+func TestMultiValue(t *testing.T) {
+	// Test: Repeated fields keep every value in order
+	headers := NewHeaders()
+	headers.Add("Set-Cookie", "a=1; Path=/")
+	headers.Add("Content-Type", "text/html")
+	headers.Add("set-cookie", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+	assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2015 07:28:00 GMT"}, headers.Values("SET-COOKIE"))
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Range walks fields in the order they were added
+	var keys []string
+	headers.Range(func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"Set-Cookie", "Content-Type", "Set-Cookie"}, keys)
+
+	// Test: Range stops when asked to
+	count := 0
+	headers.Range(func(key, value string) bool {
+		count++
+		return false
+	})
+	assert.Equal(t, 1, count)
+
+	// Test: Set replaces every value and keeps the first position
+	headers.Set("Set-Cookie", "c=3")
+	assert.Equal(t, []string{"c=3"}, headers.Values("set-cookie"))
+	keys = nil
+	headers.Range(func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	assert.Equal(t, []string{"Set-Cookie", "Content-Type"}, keys)
+
+	// Test: Set appends a new field
+	headers.Set("X-New", "yes")
+	value, ok := headers.Get("x-new")
+	assert.True(t, ok)
+	assert.Equal(t, "yes", value)
+	assert.Equal(t, 3, headers.Len())
+
+	// Test: Del removes every value
+	headers.Add("X-New", "again")
+	headers.Del("x-new")
+	_, ok = headers.Get("X-New")
+	assert.False(t, ok)
+	assert.Nil(t, headers.Values("X-New"))
+	assert.Equal(t, 2, headers.Len())
+
+	// Test: Parsed duplicates are kept as separate values
+	headers = NewHeaders()
+	data := []byte("Accept: text/html\r\nAccept: */*\r\n\r\n")
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"text/html", "*/*"}, headers.Values("accept"))
+}
+
+func TestNameCasing(t *testing.T) {
+	// Test: Parsed names keep their original spelling
+	headers := NewHeaders()
+	data := []byte("content-TYPE: text/html\r\nX-Request-ID: 42\r\n\r\n")
+	n, _, err := headers.Parse(data)
+	require.NoError(t, err)
+	_, _, err = headers.Parse(data[n:])
+	require.NoError(t, err)
+
+	var raw, canonical []string
+	headers.RangeRaw(func(key, value string) bool {
+		raw = append(raw, key)
+		return true
+	})
+	headers.Range(func(key, value string) bool {
+		canonical = append(canonical, key)
+		return true
+	})
+	assert.Equal(t, []string{"content-TYPE", "X-Request-ID"}, raw)
+	assert.Equal(t, []string{"Content-Type", "X-Request-Id"}, canonical)
+
+	// Test: Lookups ignore case whatever the spelling
+	value, ok := headers.Get("Content-Type")
+	assert.True(t, ok)
+	assert.Equal(t, "text/html", value)
+
+	// Test: Add and Set store the canonical name, the raw variants don't
+	headers = NewHeaders()
+	headers.Add("content-length", "5")
+	headers.Set("x-forwarded-for", "10.0.0.1")
+	headers.AddRaw("x-upstream-ID", "abc")
+	raw = nil
+	headers.RangeRaw(func(key, value string) bool {
+		raw = append(raw, key)
+		return true
+	})
+	assert.Equal(t, []string{"Content-Length", "X-Forwarded-For", "x-upstream-ID"}, raw)
+
+	// Test: Canonical names
+	assert.Equal(t, "Content-Type", CanonicalName("content-type"))
+	assert.Equal(t, "Www-Authenticate", CanonicalName("WWW-AUTHENTICATE"))
+	assert.Equal(t, "X-Content-Sha256", CanonicalName("X-Content-SHA256"))
+	assert.Equal(t, "Host", CanonicalName("host"))
+	assert.Equal(t, "not a token", CanonicalName("not a token"))
+}
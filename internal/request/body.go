@@ -0,0 +1,289 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxBodyDrain is how much of an unread body Close will discard to keep the
+// connection usable. Bodies with more left over than this are not drained.
+const maxBodyDrain = 256 << 10
+
+// maxChunkSizeLine bounds a chunk-size line, extensions included.
+const maxChunkSizeLine = 4 << 10
+
+// minBodyBuffer is how large the Reader's buffer is made for reading a body
+// through it, so a large body doesn't take one small read after another.
+const minBodyBuffer = 4 << 10
+
+// body reads a request body lazily from the connection's Reader, decoding the
+// Content-Length or chunked framing as the bytes arrive.
+type body struct {
+	reader  *Reader
+	request *Request
+	err     error
+	closed  bool
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, ErrBodyReadAfterClose
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	rd, r := b.reader, b.request
+	if send := r.sendContinue; send != nil && r.state != done {
+		// the client holds the body back until it is told to go ahead
+		r.sendContinue = nil
+		if err := send(); err != nil {
+			b.err = err
+			return 0, b.err
+		}
+	}
+	for r.state != done {
+		if rd.readToIndex == 0 && r.state == requestStateParsingBody && !rd.eof {
+			// nothing is buffered, so the body can go straight to the caller
+			n, err := rd.readInto(p[:min(len(p), r.bodyRemaining)])
+			if err != nil {
+				b.err = err
+				return 0, b.err
+			}
+			r.bodyRemaining -= n
+			if r.bodyRemaining == 0 {
+				r.state = done
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		consumed, written, err := r.parseBody(rd.buffer[:rd.readToIndex], p)
+		if err != nil {
+			b.err = fmt.Errorf("error parsing request body: %w", err)
+			return 0, b.err
+		}
+		rd.consume(consumed)
+
+		if written > 0 {
+			return written, nil
+		}
+		if consumed > 0 {
+			continue
+		}
+
+		if rd.eof {
+			reason := "connection closed before the chunked body ended"
+			if r.state == requestStateParsingBody {
+				reason = "body length is less than reported content length"
+			}
+			b.err = fmt.Errorf("%w: %s: %w", ErrIncompleteRequest, reason, io.ErrUnexpectedEOF)
+			return 0, b.err
+		}
+		rd.grow(minBodyBuffer)
+		err = rd.read()
+		if err != nil {
+			b.err = err
+			return 0, b.err
+		}
+	}
+	return 0, io.EOF
+}
+
+// Close discards whatever is left of the body so the next request on the
+// connection can be read. It returns an error if the body could not be
+// consumed, in which case the connection can't be reused.
+func (b *body) Close() error {
+	if b.closed {
+		return b.err
+	}
+	if b.request.ContinuePending() {
+		// the body won't come without a 100 Continue, so it can't be skipped
+		b.closed = true
+		b.err = ErrBodyNotDrained
+		return b.err
+	}
+
+	_, err := io.CopyN(io.Discard, b, maxBodyDrain)
+	b.closed = true
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if b.request.state != done {
+		b.err = ErrBodyNotDrained
+		return b.err
+	}
+	return nil
+}
+
+// prepareBody picks how the body is framed once the headers are parsed.
+func (r *Request) prepareBody() error {
+	transferEncoding, chunked := r.Headers.Get("Transfer-Encoding")
+	contentLength, hasLength := r.Headers.Get("Content-Length")
+
+	if chunked {
+		if hasLength {
+			// a message with both is a request smuggling attempt (RFC 9112 6.3)
+			return ErrConflictingFraming
+		}
+		if !strings.EqualFold(strings.TrimSpace(transferEncoding), "chunked") {
+			return fmt.Errorf("%w: %s", ErrUnsupportedTransferEncoding, transferEncoding)
+		}
+
+		r.state = requestStateParsingChunkSize
+		return nil
+	}
+
+	// if no content length header, there is no body
+	if !hasLength {
+		r.state = done
+		return nil
+	}
+
+	length, err := parseContentLength(contentLength)
+	if err != nil {
+		return err
+	}
+
+	if err := r.checkBodySize(length); err != nil {
+		return err
+	}
+
+	if length == 0 {
+		r.state = done
+		return nil
+	}
+
+	r.bodyRemaining = length
+	r.state = requestStateParsingBody
+	return nil
+}
+
+// parseContentLength parses a Content-Length value, which is only digits
+// (RFC 9110 8.6). strconv.Atoi alone would also take a sign, and a length
+// read differently than a proxy in front of the server reads it opens the
+// way to request smuggling.
+func parseContentLength(value string) (int, error) {
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidContentLength, value)
+	}
+	return length, nil
+}
+
+// parseBody decodes the body framing in data, copying body bytes into p. It
+// returns how many bytes of data were consumed and how many were written to p.
+func (r *Request) parseBody(data, p []byte) (int, int, error) {
+	switch r.state {
+	case requestStateParsingBody:
+		// anything past the content length belongs to the next request
+		n := copy(p, data[:min(len(data), r.bodyRemaining)])
+		r.bodyRemaining -= n
+
+		if r.bodyRemaining == 0 {
+			r.state = done
+		}
+
+		return n, n, nil
+	case requestStateParsingChunkSize:
+		size, numBytes, err := parseChunkSize(data)
+		if err != nil {
+			return 0, 0, err
+		}
+		if numBytes == 0 {
+			return 0, 0, nil
+		}
+
+		r.bodySize += size
+		if err := r.checkBodySize(r.bodySize); err != nil {
+			return 0, 0, err
+		}
+
+		if size == 0 {
+			// the last chunk, only trailers are left
+			r.state = requestStateParsingTrailers
+		} else {
+			r.bodyRemaining = size
+			r.state = requestStateParsingChunkData
+		}
+		return numBytes, 0, nil
+	case requestStateParsingChunkData:
+		if r.bodyRemaining > 0 {
+			n := copy(p, data[:min(len(data), r.bodyRemaining)])
+			r.bodyRemaining -= n
+			return n, n, nil
+		}
+
+		// every chunk's data is followed by a CRLF
+		if len(data) < 2 {
+			return 0, 0, nil
+		}
+		if string(data[:2]) != "\r\n" {
+			return 0, 0, fmt.Errorf("%w: chunk data is longer than its size", ErrMalformedChunk)
+		}
+
+		r.state = requestStateParsingChunkSize
+		return 2, 0, nil
+	case requestStateParsingTrailers:
+		if err := r.checkFieldLine(data); err != nil {
+			return 0, 0, err
+		}
+
+		numBytes, end, err := r.Trailers.Parse(data)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if end {
+			r.state = done
+			return numBytes + 2, 0, nil
+		}
+
+		if numBytes > 0 {
+			r.fieldBytes += numBytes
+			r.fieldCount++
+		}
+		return numBytes, 0, nil
+	default:
+		return 0, 0, fmt.Errorf("error: unknown body state")
+	}
+}
+
+// parseChunkSize parses a chunk-size line such as "1a;name=value\r\n". Chunk
+// extensions are ignored. It returns 0 bytes parsed if the line is incomplete.
+func parseChunkSize(data []byte) (int, int, error) {
+	dataString := string(data)
+	if !strings.Contains(dataString, "\r\n") {
+		if len(data) > maxChunkSizeLine {
+			return 0, 0, fmt.Errorf("%w: chunk size line too long", ErrMalformedChunk)
+		}
+		return 0, 0, nil
+	}
+
+	line := strings.Split(dataString, "\r\n")[0]
+	if len(line) > maxChunkSizeLine {
+		return 0, 0, fmt.Errorf("%w: chunk size line too long", ErrMalformedChunk)
+	}
+	sizeString, _, _ := strings.Cut(line, ";")
+	sizeString = strings.TrimRight(sizeString, " \t")
+
+	size, err := strconv.ParseInt(sizeString, 16, 32)
+	if err != nil || size < 0 || strings.HasPrefix(sizeString, "+") {
+		return 0, 0, fmt.Errorf("%w: invalid chunk size: %s", ErrMalformedChunk, line)
+	}
+
+	return int(size), len(line) + 2, nil
+}
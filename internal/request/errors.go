@@ -0,0 +1,28 @@
+package request
+
+import "errors"
+
+// Errors returned while reading a request. They are wrapped with details about
+// the offending input, so compare them with errors.Is.
+var (
+	ErrMalformedRequestLine        = errors.New("malformed request line")
+	ErrInvalidMethod               = errors.New("invalid method")
+	ErrInvalidTarget               = errors.New("invalid request target")
+	ErrInvalidVersion              = errors.New("invalid HTTP version")
+	ErrUnsupportedVersion          = errors.New("unsupported HTTP version")
+	ErrIncompleteRequest           = errors.New("incomplete request")
+	ErrInvalidContentLength        = errors.New("invalid content length")
+	ErrConflictingFraming          = errors.New("both transfer encoding and content length are set")
+	ErrUnsupportedTransferEncoding = errors.New("unsupported transfer encoding")
+	ErrUnsupportedExpectation      = errors.New("unsupported expectation")
+	ErrMissingHost                 = errors.New("missing Host header")
+	ErrInvalidHost                 = errors.New("invalid Host header")
+	ErrMalformedChunk              = errors.New("malformed chunk")
+
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeaderTooLarge     = errors.New("request header fields too large")
+	ErrBodyTooLarge       = errors.New("request body too large")
+
+	ErrBodyReadAfterClose = errors.New("read on closed body")
+	ErrBodyNotDrained     = errors.New("too much of the body was left unread to drain")
+)
@@ -0,0 +1,84 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	defaultMaxRequestLineLength = 8 << 10
+	defaultMaxHeaderBytes       = 1 << 20
+	defaultMaxHeaderCount       = 100
+	defaultMaxBodySize          = 10 << 20
+)
+
+// Limits bounds how much a client can make the parser hold. A zero field
+// means the matching default.
+type Limits struct {
+	// MaxRequestLineLength is the longest request line accepted, CRLF excluded
+	MaxRequestLineLength int
+	// MaxHeaderBytes bounds the header section, and separately the trailer
+	// section of a chunked body
+	MaxHeaderBytes int
+	// MaxHeaderCount bounds the number of header fields, and separately the
+	// number of trailer fields
+	MaxHeaderCount int
+	// MaxBodySize is the largest body accepted, after chunked decoding
+	MaxBodySize int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxRequestLineLength <= 0 {
+		l.MaxRequestLineLength = defaultMaxRequestLineLength
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = defaultMaxHeaderCount
+	}
+	if l.MaxBodySize <= 0 {
+		l.MaxBodySize = defaultMaxBodySize
+	}
+	return l
+}
+
+// checkRequestLine fails once the request line at the start of data is known
+// to be longer than allowed, whether or not it is complete yet.
+func (r *Request) checkRequestLine(data []byte) error {
+	length := bytes.Index(data, []byte("\r\n"))
+	if length == -1 {
+		length = len(data)
+	}
+
+	if length > r.limits.MaxRequestLineLength {
+		return fmt.Errorf("%w: more than %d bytes", ErrRequestLineTooLong, r.limits.MaxRequestLineLength)
+	}
+	return nil
+}
+
+// checkFieldLine fails if the next field line in data, complete or not, would
+// take the current header or trailer section over its byte or count limit.
+func (r *Request) checkFieldLine(data []byte) error {
+	lineEnd := bytes.Index(data, []byte("\r\n"))
+	length := len(data)
+	if lineEnd != -1 {
+		length = lineEnd + 2
+	}
+
+	if r.fieldBytes+length > r.limits.MaxHeaderBytes {
+		return fmt.Errorf("%w: more than %d bytes", ErrHeaderTooLarge, r.limits.MaxHeaderBytes)
+	}
+	// the empty line ending the section doesn't count as a field
+	if lineEnd > 0 && r.fieldCount >= r.limits.MaxHeaderCount {
+		return fmt.Errorf("%w: more than %d fields", ErrHeaderTooLarge, r.limits.MaxHeaderCount)
+	}
+	return nil
+}
+
+func (r *Request) checkBodySize(size int) error {
+	if size > r.limits.MaxBodySize {
+		return fmt.Errorf("%w: more than %d bytes", ErrBodyTooLarge, r.limits.MaxBodySize)
+	}
+	return nil
+}
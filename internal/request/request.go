@@ -3,7 +3,6 @@ package request
 import (
 	"fmt"
 	"io"
-	"strconv"
 	"strings"
 	"unicode"
 
@@ -19,65 +18,194 @@ const (
 	done
 	requestStateParsingHeaders
 	requestStateParsingBody
+	requestStateParsingChunkSize
+	requestStateParsingChunkData
+	requestStateParsingTrailers
 )
 
 type Request struct {
 	RequestLine RequestLine
-	state       state
-	Headers     headers.Headers
-	Body        []byte
+	// URL is the request target parsed into its path and query
+	URL     *URL
+	state   state
+	Headers *headers.Headers
+	// Body streams the body from the connection as it is read. It is never nil,
+	// a request without a body reads as empty.
+	Body io.ReadCloser
+	// Trailers holds the trailer fields sent after a chunked body, once Body
+	// has been read to the end
+	Trailers *headers.Headers
+	// RemoteAddr is the address of the client, set by the server
+	RemoteAddr string
+
+	// pathValues are the path parameters set by whatever routed the request
+	pathValues map[string]string
+	// host is the host name the request is for, see Host
+	host string
+	// sendContinue is called before the body is first read, see OnContinue
+	sendContinue func() error
+
+	limits        Limits
+	fieldBytes    int
+	fieldCount    int
+	bodySize      int
+	bodyRemaining int
 }
 
 type RequestLine struct {
 	HttpVersion   string
 	RequestTarget string
 	Method        string
+	// TargetForm is how RequestTarget is written. Absolute-form and
+	// authority-form targets name a Host, and a Port when they give one or
+	// their scheme has a default.
+	TargetForm TargetForm
+	Host       string
+	Port       string
+}
+
+// Reader reads consecutive requests from one connection. Bytes read past the
+// end of a request are kept for the next one, so pipelined requests are not lost.
+type Reader struct {
+	reader      io.Reader
+	buffer      []byte
+	readToIndex int
+	eof         bool
+	current     *Request
+	// last is the request ReadRequest last started, see LastRequest
+	last   *Request
+	limits Limits
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderWithLimits(reader, Limits{})
+}
+
+func NewReaderWithLimits(reader io.Reader, limits Limits) *Reader {
+	return &Reader{
+		reader: reader,
+		buffer: make([]byte, bufferSize),
+		limits: limits.withDefaults(),
+	}
 }
 
 func RequestFromReader(reader io.Reader) (*Request, error) {
+	return NewReader(reader).ReadRequest()
+}
 
-	buffer := make([]byte, bufferSize, bufferSize)
-	readToIndex := 0
+// ReadRequest reads the request line and headers of the next request from the
+// connection. The body is left on the connection to be read through Body; any
+// of it still unread is discarded when the next request is read. It returns
+// io.EOF if the connection was closed before another request was started.
+func (rd *Reader) ReadRequest() (*Request, error) {
+	request := &Request{
+		state:    initialized,
+		Headers:  headers.NewHeaders(),
+		Trailers: headers.NewHeaders(),
+		limits:   rd.limits,
+	}
+	request.Body = &body{reader: rd, request: request}
+	rd.last = request
 
-	request := Request{
-		state:   initialized,
-		Headers: headers.NewHeaders(),
+	if rd.current != nil {
+		// the previous body has to be consumed before the next request starts
+		if err := rd.current.Body.Close(); err != nil {
+			return nil, err
+		}
+		rd.current = nil
 	}
 
-	for request.state != done {
-		if readToIndex == len(buffer) {
-			newBuffer := make([]byte, len(buffer)*2)
-			copy(newBuffer, buffer)
-			buffer = newBuffer
+	for request.state == initialized || request.state == requestStateParsingHeaders {
+		// parse what is already buffered first, a pipelined request may be complete
+		bytesParsed, err := request.parse(rd.buffer[:rd.readToIndex])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing request: %w", err)
 		}
+		rd.consume(bytesParsed)
 
-		bytesRead, err := reader.Read(buffer[readToIndex:])
-		if err == io.EOF {
+		if request.state != initialized && request.state != requestStateParsingHeaders {
 			break
-		} else if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("error reading from reader: %v", err)
 		}
+		if rd.eof {
+			if request.state == initialized && rd.readToIndex == 0 {
+				// the reader was closed before a new request started
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("%w: all data parsed, but no end was found", ErrIncompleteRequest)
+		}
+
+		err = rd.read()
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		readToIndex += bytesRead
+	rd.current = request
+	return request, nil
+}
 
-		bytesParsed, err := request.parse(buffer[:readToIndex])
+// LastRequest returns the request ReadRequest was last called for. When that
+// failed, it holds whatever of the request line and headers had been parsed,
+// to log the failure with; its RequestLine is empty if the line was invalid.
+func (rd *Reader) LastRequest() *Request {
+	return rd.last
+}
+
+// WaitForData blocks until some bytes of the next request are available. It
+// returns io.EOF if the connection is closed first.
+func (rd *Reader) WaitForData() error {
+	for rd.readToIndex == 0 {
+		if rd.eof {
+			return io.EOF
+		}
+		err := rd.read()
 		if err != nil {
-			return nil, fmt.Errorf("error parsing request: %v", err)
-		} else if bytesParsed == 0 {
-			continue
+			return err
 		}
+	}
+	return nil
+}
+
+func (rd *Reader) consume(n int) {
+	copy(rd.buffer, rd.buffer[n:rd.readToIndex])
+	rd.readToIndex -= n
+}
+
+// readInto reads from the connection straight into p, bypassing the buffer.
+func (rd *Reader) readInto(p []byte) (int, error) {
+	n, err := rd.reader.Read(p)
+	if err == io.EOF {
+		rd.eof = true
+	} else if err != nil {
+		return n, fmt.Errorf("error reading from reader: %w", err)
+	}
+	return n, nil
+}
 
-		copy(buffer, buffer[bytesParsed:readToIndex])
-		readToIndex -= bytesParsed
+// grow makes the buffer at least size bytes long.
+func (rd *Reader) grow(size int) {
+	if len(rd.buffer) < size {
+		newBuffer := make([]byte, size)
+		copy(newBuffer, rd.buffer[:rd.readToIndex])
+		rd.buffer = newBuffer
 	}
+}
 
-	if request.state != done && request.state != requestStateParsingBody {
-		return nil, fmt.Errorf("incomplete request: all data parsed, but no end was found")
-	} else if request.state == requestStateParsingBody {
-		return nil, fmt.Errorf("incomplete request: body length is less than reported content length")
+func (rd *Reader) read() error {
+	if rd.readToIndex == len(rd.buffer) {
+		newBuffer := make([]byte, len(rd.buffer)*2)
+		copy(newBuffer, rd.buffer)
+		rd.buffer = newBuffer
 	}
 
-	return &request, nil
+	bytesRead, err := rd.reader.Read(rd.buffer[rd.readToIndex:])
+	rd.readToIndex += bytesRead
+	if err == io.EOF {
+		rd.eof = true
+	} else if err != nil {
+		return fmt.Errorf("error reading from reader: %w", err)
+	}
+	return nil
 }
 
 func parseRequestLine(request string) (RequestLine, int, error) {
@@ -89,12 +217,16 @@ func parseRequestLine(request string) (RequestLine, int, error) {
 
 	parts := strings.Split(requestLine, " ")
 	if len(parts) != 3 {
-		return RequestLine{}, 0, fmt.Errorf("invalid request line: %s", requestLine)
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", ErrMalformedRequestLine, requestLine)
 	}
 
-	httpVersion := strings.Split(parts[2], "/")[1]
-	if httpVersion != "1.1" {
-		return RequestLine{}, 0, fmt.Errorf("invalid HTTP version: %s", httpVersion)
+	// HTTP-version = "HTTP/" DIGIT "." DIGIT (RFC 9112 2.3)
+	httpVersion, ok := strings.CutPrefix(parts[2], "HTTP/")
+	if !ok || len(httpVersion) != 3 || !isDigit(httpVersion[0]) || httpVersion[1] != '.' || !isDigit(httpVersion[2]) {
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", ErrInvalidVersion, parts[2])
+	}
+	if httpVersion != "1.0" && httpVersion != "1.1" {
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", ErrUnsupportedVersion, httpVersion)
 	}
 
 	// Check if all characters in the method are letters
@@ -102,7 +234,7 @@ func parseRequestLine(request string) (RequestLine, int, error) {
 
 	//
 	if strings.ToUpper(parts[0]) != parts[0] || !methodValid {
-		return RequestLine{}, 0, fmt.Errorf("invalid method: %s", parts[0])
+		return RequestLine{}, 0, fmt.Errorf("%w: %s", ErrInvalidMethod, parts[0])
 	}
 
 	return RequestLine{
@@ -121,9 +253,11 @@ func isAllLetters(s string) bool {
 	return true
 }
 
+// parse parses the request line and headers. It stops once the headers end,
+// the body is decoded separately by parseBody as it is read.
 func (r *Request) parse(data []byte) (int, error) {
 	totalBytesParsed := 0
-	for r.state != done {
+	for r.state == initialized || r.state == requestStateParsingHeaders {
 		// fmt.Println("parsing data:", string(data[totalBytesParsed:]))
 		n, err := r.parseSingle(data[totalBytesParsed:])
 		if err != nil {
@@ -143,6 +277,15 @@ func (r *Request) parse(data []byte) (int, error) {
 func (r *Request) parseSingle(data []byte) (int, error) {
 	switch r.state {
 	case initialized:
+		// ignore empty lines received before the request line (RFC 9112 2.2)
+		if len(data) >= 2 && string(data[:2]) == "\r\n" {
+			return 2, nil
+		}
+
+		if err := r.checkRequestLine(data); err != nil {
+			return 0, err
+		}
+
 		requestLine, numBytes, err := parseRequestLine(string(data))
 		if err != nil {
 			return 0, err
@@ -151,65 +294,172 @@ func (r *Request) parseSingle(data []byte) (int, error) {
 			return 0, nil
 		}
 
+		url, err := parseRequestTarget(&requestLine)
+		if err != nil {
+			return 0, err
+		}
+
 		r.state = requestStateParsingHeaders
 		r.RequestLine = requestLine
+		r.URL = url
 		return numBytes, nil
 	case done:
 		return 0, fmt.Errorf("error: trying to read data in a done state")
 	case requestStateParsingHeaders:
+		if err := r.checkFieldLine(data); err != nil {
+			return 0, err
+		}
+
 		numBytes, end, err := r.Headers.Parse(data)
 		if err != nil {
 			return 0, err
 		}
 
 		if end {
-			r.state = requestStateParsingBody
+			// trailers are limited separately from the headers
+			r.fieldBytes, r.fieldCount = 0, 0
+			err := r.prepareBody()
+			if err != nil {
+				return 0, err
+			}
+			if err := r.checkHost(); err != nil {
+				return 0, err
+			}
+			if err := r.checkExpect(); err != nil {
+				return 0, err
+			}
 			return numBytes + 2, nil
 		}
 
+		if numBytes > 0 {
+			r.fieldBytes += numBytes
+			r.fieldCount++
+		}
 		return numBytes, nil
-	case requestStateParsingBody:
-		contentLength, ok := r.Headers.Get("Content-Length")
+	default:
+		return 0, fmt.Errorf("error: unknown state")
+	}
+}
 
-		// if no content length header, return
-		if !ok {
-			r.state = done
-			return 0, nil
-		}
+// KeepAlive reports whether the client allows the connection to be reused
+// after this request, following the persistence rules of RFC 9112 section 9.3.
+// HTTP/1.1 connections persist unless the client sends "close", HTTP/1.0 ones
+// only if it asks for "keep-alive".
+func (r *Request) KeepAlive() bool {
+	connection, _ := r.Headers.Get("Connection")
+	if headers.HasToken(connection, "close") {
+		return false
+	}
+	if r.RequestLine.HttpVersion == "1.0" {
+		return headers.HasToken(connection, "keep-alive")
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
 
-		r.Body = append(r.Body, data...)
-		//fmt.Println(string(r.Body))
+// checkHost enforces the Host rules of RFC 9112 3.2: an HTTP/1.1 request has
+// exactly one Host field, and no request has several or an invalid one. The
+// host of an absolute-form or authority-form target takes precedence over the
+// field's.
+func (r *Request) checkHost() error {
+	values := r.Headers.Values("Host")
+	if len(values) > 1 {
+		return fmt.Errorf("%w: %d Host fields", ErrInvalidHost, len(values))
+	}
+	if len(values) == 0 && r.RequestLine.HttpVersion != "1.0" {
+		return ErrMissingHost
+	}
 
-		length, err := strconv.Atoi(contentLength)
+	if len(values) == 1 && values[0] != "" {
+		host, _, err := parseAuthority(values[0])
 		if err != nil {
-			return 0, fmt.Errorf("error: invalid content length: %v", err)
+			return fmt.Errorf("%w: %q", ErrInvalidHost, values[0])
 		}
+		r.host = host
+	}
+	if r.RequestLine.Host != "" {
+		r.host = r.RequestLine.Host
+	}
+	return nil
+}
 
-		// fmt.Printf("Content Length: %d\n Body Length: %d\n", length, len(r.Body))
+// checkExpect rejects expectations other than 100-continue, the only one
+// defined (RFC 9110 10.1.1).
+func (r *Request) checkExpect() error {
+	expect, ok := r.Headers.Get("Expect")
+	if ok && !strings.EqualFold(expect, "100-continue") {
+		return fmt.Errorf("%w: %s", ErrUnsupportedExpectation, expect)
+	}
+	return nil
+}
 
-		if length == len(r.Body) {
-			r.state = done
-		} else if length < len(r.Body) {
-			return 0, fmt.Errorf("error: body length is greater than reported content length")
-		}
+// ExpectsContinue reports whether the client sent Expect: 100-continue, so it
+// may hold the body back until it gets a 100 Continue. The expectation is
+// ignored in HTTP/1.0 requests.
+func (r *Request) ExpectsContinue() bool {
+	_, ok := r.Headers.Get("Expect")
+	return ok && r.RequestLine.HttpVersion != "1.0"
+}
 
-		return len(data), nil
-	default:
-		return 0, fmt.Errorf("error: unknown state")
+// OnContinue sets send to be called the first time the body is read when the
+// client expects a 100 Continue, to tell it to go ahead. A handler that answers
+// without reading the body, with a 417 or 413 say, never sends one.
+func (r *Request) OnContinue(send func() error) {
+	if r.ExpectsContinue() {
+		r.sendContinue = send
 	}
 }
 
+// ContinuePending reports whether the client may still be waiting for a 100
+// Continue before sending the body. Since the body may or may not follow, the
+// connection can't be reused.
+func (r *Request) ContinuePending() bool {
+	return r.sendContinue != nil && r.state != done
+}
+
+// Host returns the host name the request is for, without its port. It is
+// empty if the client didn't name one, which only HTTP/1.0 clients may do.
+func (r *Request) Host() string {
+	return r.host
+}
+
+// PathValue returns the path parameter with the given name, or an empty string
+// if the route that matched the request has no such parameter.
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
+}
+
+// SetPathValue sets a path parameter, for routers to record what they matched.
+func (r *Request) SetPathValue(name, value string) {
+	if r.pathValues == nil {
+		r.pathValues = make(map[string]string)
+	}
+	r.pathValues[name] = value
+}
+
+// ReadBody reads the rest of the body into memory.
+func (r *Request) ReadBody() ([]byte, error) {
+	return io.ReadAll(r.Body)
+}
+
 func (r *Request) PrintRequest() {
 	fmt.Println("Request line:")
 	fmt.Println("- Method:", r.RequestLine.Method)
 	fmt.Println("- Target:", r.RequestLine.RequestTarget)
 	fmt.Println("- Version:", r.RequestLine.HttpVersion)
 	fmt.Println("Headers:")
-	for key, value := range r.Headers {
+	r.Headers.RangeRaw(func(key, value string) bool {
 		fmt.Printf("- %s: %s\n", key, value)
-	}
-	if len(r.Body) > 0 {
+		return true
+	})
+	body, err := r.ReadBody()
+	if err != nil {
+		fmt.Println("Error reading body:", err)
+	} else if len(body) > 0 {
 		fmt.Println("Body:")
-		fmt.Println(string(r.Body))
+		fmt.Println(string(body))
 	}
 }
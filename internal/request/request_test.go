@@ -5,6 +5,8 @@ import (
 	"strings"
 	"testing"
 
+	"httpfromtcp/internal/headers"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -50,16 +52,139 @@ func TestRequestLineParse(t *testing.T) {
 
 	// Test: Invalid number of parts in request line
 	_, err = RequestFromReader(strings.NewReader("/coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrMalformedRequestLine)
 
 	// Test: Invalid method Request line
 	_, err = RequestFromReader(strings.NewReader("get /coffee HTTP/1.1\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrInvalidMethod)
 
 	// Test: Invalid version in Request line
 	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.2\r\nHost: localhost:42069\r\nUser-Agent: curl/7.81.0\r\nAccept: */*\r\n\r\n"))
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+	_, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/2.0\r\nHost: localhost:42069\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
 
+	// Test: HTTP/1.0 request line
+	r, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.0", r.RequestLine.HttpVersion)
+
+	// Test: Malformed versions
+	for _, version := range []string{"HTTP1.1", "HTTP/1", "HTTP/1.1.1", "http/1.1", "HTTP/a.b", "FOO"} {
+		_, err = RequestFromReader(strings.NewReader("GET /coffee " + version + "\r\nHost: localhost:42069\r\n\r\n"))
+		require.ErrorIs(t, err, ErrInvalidVersion, version)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	for _, tc := range []struct {
+		version    string
+		connection string
+		keepAlive  bool
+	}{
+		{"1.1", "", true},
+		{"1.1", "close", false},
+		{"1.1", "keep-alive", true},
+		{"1.0", "", false},
+		{"1.0", "Keep-Alive", true},
+		{"1.0", "keep-alive, close", false},
+	} {
+		// Test: Persistence depends on the version and Connection
+		raw := "GET / HTTP/" + tc.version + "\r\nHost: localhost\r\n"
+		if tc.connection != "" {
+			raw += "Connection: " + tc.connection + "\r\n"
+		}
+		r, err := RequestFromReader(strings.NewReader(raw + "\r\n"))
+		require.NoError(t, err)
+		assert.Equal(t, tc.keepAlive, r.KeepAlive(), "HTTP/%s Connection: %s", tc.version, tc.connection)
+	}
+}
+
+func TestHost(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		host string
+		err  error
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n", "example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: [::1]:8080\r\n\r\n", "[::1]", nil},
+		{"GET / HTTP/1.1\r\nHost: \r\n\r\n", "", nil},
+		{"GET / HTTP/1.0\r\n\r\n", "", nil},
+		{"GET http://example.com/ HTTP/1.1\r\nHost: other.com\r\n\r\n", "example.com", nil},
+		{"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", "example.com", nil},
+		{"GET / HTTP/1.1\r\n\r\n", "", ErrMissingHost},
+		{"GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n", "", ErrInvalidHost},
+		{"GET / HTTP/1.0\r\nHost: a.com\r\nhost: a.com\r\n\r\n", "", ErrInvalidHost},
+		{"GET / HTTP/1.1\r\nHost: user@example.com\r\n\r\n", "", ErrInvalidHost},
+		{"GET / HTTP/1.1\r\nHost: example.com:http\r\n\r\n", "", ErrInvalidHost},
+	} {
+		// Test: Host is required once in HTTP/1.1 and the target's host wins
+		r, err := RequestFromReader(strings.NewReader(tc.raw))
+		if tc.err != nil {
+			require.ErrorIs(t, err, tc.err, tc.raw)
+			continue
+		}
+		require.NoError(t, err, tc.raw)
+		assert.Equal(t, tc.host, r.Host(), tc.raw)
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	// Test: Continue is sent once, when the body is first read
+	continued := 0
+	r, err := RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-Continue\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.True(t, r.ExpectsContinue())
+	r.OnContinue(func() error {
+		continued++
+		return nil
+	})
+	assert.True(t, r.ContinuePending())
+	assert.Equal(t, 0, continued)
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.Equal(t, 1, continued)
+	assert.False(t, r.ContinuePending())
+
+	// Test: Body that was never asked for isn't drained
+	reader := NewReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	r.OnContinue(func() error {
+		continued++
+		return nil
+	})
+	require.ErrorIs(t, r.Body.Close(), ErrBodyNotDrained)
+	assert.Equal(t, 1, continued)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyNotDrained)
+
+	// Test: Nothing is pending without a body
+	r, err = RequestFromReader(strings.NewReader("GET / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\n\r\n"))
+	require.NoError(t, err)
+	r.OnContinue(func() error {
+		continued++
+		return nil
+	})
+	assert.False(t, r.ContinuePending())
+	assert.Equal(t, "", readBody(t, r))
+	assert.Equal(t, 1, continued)
+
+	// Test: HTTP/1.0 requests ignore the expectation
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.0\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	assert.False(t, r.ExpectsContinue())
+	r.OnContinue(func() error {
+		continued++
+		return nil
+	})
+	assert.False(t, r.ContinuePending())
+	assert.Equal(t, "hello", readBody(t, r))
+	assert.Equal(t, 1, continued)
+
+	// Test: Other expectations are rejected
+	_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 200-ok\r\n\r\n"))
+	require.ErrorIs(t, err, ErrUnsupportedExpectation)
 }
 
 func TestHeaders(t *testing.T) {
@@ -71,9 +196,9 @@ func TestHeaders(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069", r.Headers["host"])
-	assert.Equal(t, "curl/7.81.0", r.Headers["user-agent"])
-	assert.Equal(t, "*/*", r.Headers["accept"])
+	assert.Equal(t, []string{"localhost:42069"}, r.Headers.Values("host"))
+	assert.Equal(t, []string{"curl/7.81.0"}, r.Headers.Values("user-agent"))
+	assert.Equal(t, []string{"*/*"}, r.Headers.Values("accept"))
 
 	// Test: Malformed Header
 	reader = &chunkReader{
@@ -81,11 +206,11 @@ func TestHeaders(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, headers.ErrMalformedFieldLine)
 
 	// Test: Empty Header
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\n\r\n",
+		data:            "GET / HTTP/1.0\r\n\r\n",
 		numBytesPerRead: 1,
 	}
 	r, err = RequestFromReader(reader)
@@ -94,23 +219,27 @@ func TestHeaders(t *testing.T) {
 
 	// Test: Duplicate headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nHost: localhost:42069\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: text/html\r\nAccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42069", r.Headers["host"])
+	value, _ := r.Headers.Get("accept")
+	assert.Equal(t, "text/html, */*", value)
+	assert.Equal(t, []string{"text/html", "*/*"}, r.Headers.Values("accept"))
 
 	// Test: Case Insensitive Headers
 	reader = &chunkReader{
-		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nhost: localhost:42069\r\n\r\n",
+		data:            "GET / HTTP/1.1\r\nHost: localhost:42069\r\nAccept: text/html\r\naccept: */*\r\n\r\n",
 		numBytesPerRead: 3,
 	}
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "localhost:42069, localhost:42069", r.Headers["host"])
+	value, _ = r.Headers.Get("ACCEPT")
+	assert.Equal(t, "text/html, */*", value)
+	assert.Equal(t, []string{"text/html", "*/*"}, r.Headers.Values("Accept"))
 
 	// Test: Missing end of headers
 	reader = &chunkReader{
@@ -118,7 +247,7 @@ func TestHeaders(t *testing.T) {
 		numBytesPerRead: 3,
 	}
 	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	require.ErrorIs(t, err, ErrIncompleteRequest)
 }
 
 func TestBody(t *testing.T) {
@@ -134,7 +263,7 @@ func TestBody(t *testing.T) {
 	r, err := RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "hello world!\n", string(r.Body))
+	assert.Equal(t, "hello world!\n", readBody(t, r))
 
 	// Test: Body shorter than reported content length
 	reader = &chunkReader{
@@ -145,8 +274,11 @@ func TestBody(t *testing.T) {
 			"partial content",
 		numBytesPerRead: 3,
 	}
-	_, err = RequestFromReader(reader)
-	require.Error(t, err)
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	assert.ErrorContains(t, err, "content length")
 
 	// Test: Empty Body, 0 reported content length
 	reader = &chunkReader{
@@ -160,7 +292,7 @@ func TestBody(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Empty Body, no reported content length
 	reader = &chunkReader{
@@ -173,7 +305,7 @@ func TestBody(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
 
 	// Test: Body with no reported content length
 	reader = &chunkReader{
@@ -186,7 +318,428 @@ func TestBody(t *testing.T) {
 	r, err = RequestFromReader(reader)
 	require.NoError(t, err)
 	require.NotNil(t, r)
-	assert.Equal(t, "", string(r.Body))
+	assert.Equal(t, "", readBody(t, r))
+}
+
+func TestChunkedBody(t *testing.T) {
+	// Test: Standard chunked body
+	reader := &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n" +
+			"7\r\n world!\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err := RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "hello world!", readBody(t, r))
+
+	// Test: Chunk extensions and upper case hex sizes
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"A;name=value\r\n0123456789\r\n" +
+			"1 ;last\r\n!\r\n" +
+			"0;done\r\n" +
+			"\r\n",
+		numBytesPerRead: 1,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "0123456789!", readBody(t, r))
+
+	// Test: Trailers after the last chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Trailer: X-Checksum\r\n" +
+			"\r\n" +
+			"3\r\nabc\r\n" +
+			"0\r\n" +
+			"X-Checksum: 900150983cd24fb0\r\n" +
+			"\r\n",
+		numBytesPerRead: 4,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "abc", readBody(t, r))
+	assert.Equal(t, []string{"900150983cd24fb0"}, r.Trailers.Values("x-checksum"))
+
+	// Test: Empty chunked body
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	require.NotNil(t, r)
+	assert.Equal(t, "", readBody(t, r))
+
+	// Test: Invalid chunk size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"zz\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Chunk data longer than its size
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"3\r\nhello\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrMalformedChunk)
+
+	// Test: Missing last chunk
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"5\r\nhello\r\n",
+		numBytesPerRead: 3,
+	}
+	r, err = RequestFromReader(reader)
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrIncompleteRequest)
+	assert.ErrorContains(t, err, "before the chunked body ended")
+	assert.NotContains(t, err.Error(), "content length")
+
+	// Test: Both transfer encoding and content length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"0\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrConflictingFraming)
+
+	// Test: Invalid content length
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: -5\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrInvalidContentLength)
+
+	// Test: Content length must be only digits
+	for _, value := range []string{"+3", "3 3", "0x3", "3, 3", "99999999999999999999"} {
+		_, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: " + value + "\r\n\r\nabc"))
+		require.ErrorIs(t, err, ErrInvalidContentLength, value)
+	}
+	for _, value := range []string{"+3", " 3", "3 ", "-3", ""} {
+		_, err = parseContentLength(value)
+		require.ErrorIs(t, err, ErrInvalidContentLength, value)
+	}
+	length, err := parseContentLength("003")
+	require.NoError(t, err)
+	assert.Equal(t, 3, length)
+
+	// Test: Unsupported transfer encoding
+	reader = &chunkReader{
+		data: "POST /submit HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Transfer-Encoding: gzip\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	}
+	_, err = RequestFromReader(reader)
+	require.ErrorIs(t, err, ErrUnsupportedTransferEncoding)
+
+	// Test: Chunked request followed by a pipelined request
+	requests := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Transfer-Encoding: chunked\r\n" +
+			"\r\n" +
+			"2\r\nhi\r\n" +
+			"0\r\n" +
+			"\r\n" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"\r\n",
+		numBytesPerRead: 5,
+	})
+	r, err = requests.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "hi", readBody(t, r))
+	r, err = requests.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+}
+
+func TestStreamingBody(t *testing.T) {
+	// Test: Request is returned before the body arrives
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\n"))
+
+	r, err := RequestFromReader(pr)
+	require.NoError(t, err)
+	assert.Equal(t, "/upload", r.RequestLine.RequestTarget)
+
+	// Test: Body is read as it arrives
+	go pw.Write([]byte("hello"))
+	buffer := make([]byte, 16)
+	n, err := r.Body.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer[:n]))
+
+	go pw.Write([]byte("world"))
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(body))
+
+	// Test: Chunked body is read as it arrives
+	pr, pw = io.Pipe()
+	defer pw.Close()
+	go pw.Write([]byte("POST /upload HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n"))
+
+	r, err = RequestFromReader(pr)
+	require.NoError(t, err)
+
+	go pw.Write([]byte("3\r\nabc\r\n"))
+	n, err = r.Body.Read(buffer)
+	require.NoError(t, err)
+	assert.Equal(t, "abc", string(buffer[:n]))
+
+	go pw.Write([]byte("0\r\nX-Done: yes\r\n\r\n"))
+	n, err = r.Body.Read(buffer)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []string{"yes"}, r.Trailers.Values("x-done"))
+
+	// Test: Unread body is skipped when the next request is read
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"\r\n",
+		numBytesPerRead: 3,
+	})
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+
+	// Test: Read after close
+	r, err = RequestFromReader(strings.NewReader("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+	require.NoError(t, err)
+	require.NoError(t, r.Body.Close())
+	_, err = r.Body.Read(buffer)
+	require.ErrorIs(t, err, ErrBodyReadAfterClose)
+
+	// Test: Large bodies are read in large reads, not through the parse buffer
+	large := strings.Repeat("x", 1<<20)
+	for _, data := range []string{
+		"POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1048576\r\n\r\n" + large,
+		"POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n100000\r\n" + large + "\r\n0\r\n\r\n",
+	} {
+		counter := &countingReader{r: strings.NewReader(data)}
+		r, err = RequestFromReader(counter)
+		require.NoError(t, err)
+		body, err := r.ReadBody()
+		require.NoError(t, err)
+		assert.Equal(t, len(large), len(body))
+		assert.Less(t, counter.reads, 1000)
+	}
+}
+
+type countingReader struct {
+	r     io.Reader
+	reads int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	cr.reads++
+	return cr.r.Read(p)
+}
+
+func TestLimits(t *testing.T) {
+	limits := Limits{
+		MaxRequestLineLength: 32,
+		MaxHeaderBytes:       64,
+		MaxHeaderCount:       3,
+		MaxBodySize:          10,
+	}
+
+	// Test: Request line within the limit
+	reader := NewReaderWithLimits(&chunkReader{
+		data:            "GET /coffee HTTP/1.1\r\nHost: localhost:42069\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err := reader.ReadRequest()
+	require.NoError(t, err)
+
+	// Test: Request line too long
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "GET /" + strings.Repeat("a", 40) + " HTTP/1.1\r\nHost: localhost\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Endless request line is rejected before it ends
+	reader = NewReaderWithLimits(strings.NewReader("GET /"+strings.Repeat("a", 1000)), limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrRequestLineTooLong)
+
+	// Test: Too many header bytes
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nX-Long: " + strings.Repeat("a", 64) + "\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Too many header fields
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+
+	// Test: Exactly the max header fields
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+
+	// Test: Content length over the body limit
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 11\r\n\r\nhello world",
+		numBytesPerRead: 3,
+	}, limits)
+	_, err = reader.ReadRequest()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Chunked body over the body limit
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello \r\n5\r\nworld\r\n0\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrBodyTooLarge)
+
+	// Test: Too many trailer fields
+	reader = NewReaderWithLimits(&chunkReader{
+		data:            "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n0\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\n\r\n",
+		numBytesPerRead: 3,
+	}, limits)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = r.ReadBody()
+	require.ErrorIs(t, err, ErrHeaderTooLarge)
+}
+
+func TestPipelining(t *testing.T) {
+	// Test: Pipelined requests are read one after another
+	reader := NewReader(&chunkReader{
+		data: "POST /first HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"Content-Length: 5\r\n" +
+			"\r\n" +
+			"hello" +
+			"GET /second HTTP/1.1\r\n" +
+			"Host: localhost:42069\r\n" +
+			"\r\n" +
+			"\r\n" +
+			"GET /third HTTP/1.1\r\n" +
+			"Host: localhost\r\n" +
+			"\r\n",
+		numBytesPerRead: 7,
+	})
+	r, err := reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/first", r.RequestLine.RequestTarget)
+	assert.Equal(t, "hello", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/second", r.RequestLine.RequestTarget)
+	assert.Equal(t, "", readBody(t, r))
+
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/third", r.RequestLine.RequestTarget)
+
+	_, err = reader.ReadRequest()
+	assert.Equal(t, io.EOF, err)
+
+	// Test: Whole pipeline delivered in a single read
+	reader = NewReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/a", r.RequestLine.RequestTarget)
+	r, err = reader.ReadRequest()
+	require.NoError(t, err)
+	assert.Equal(t, "/b", r.RequestLine.RequestTarget)
+
+	// Test: Truncated second request
+	reader = NewReader(strings.NewReader("GET /a HTTP/1.1\r\nHost: localhost\r\n\r\nGET /b HTTP/1.1\r\nHost: local"))
+	_, err = reader.ReadRequest()
+	require.NoError(t, err)
+	_, err = reader.ReadRequest()
+	require.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
+
+func readBody(t *testing.T, r *Request) string {
+	t.Helper()
+	body, err := r.ReadBody()
+	require.NoError(t, err)
+	return string(body)
 }
 
 type chunkReader struct {
@@ -213,3 +766,119 @@ func (cr *chunkReader) Read(p []byte) (n int, err error) {
 	}
 	return n, nil
 }
+
+func TestTarget(t *testing.T) {
+	// Test: Path and query are split and decoded, raw forms kept
+	r, err := RequestFromReader(strings.NewReader("GET /a%20b/c%2Fd?q=go+lang&tag=x&tag=y%26z&empty=&flag HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	require.NotNil(t, r.URL)
+	assert.Equal(t, "/a%20b/c%2Fd?q=go+lang&tag=x&tag=y%26z&empty=&flag", r.RequestLine.RequestTarget)
+	assert.Equal(t, "/a b/c/d", r.URL.Path)
+	assert.Equal(t, "/a%20b/c%2Fd", r.URL.RawPath)
+	assert.Equal(t, "q=go+lang&tag=x&tag=y%26z&empty=&flag", r.URL.RawQuery)
+	assert.Equal(t, "go lang", r.URL.Query.Get("q"))
+	assert.Equal(t, []string{"x", "y&z"}, r.URL.Query["tag"])
+	assert.True(t, r.URL.Query.Has("empty"))
+	assert.Equal(t, "", r.URL.Query.Get("empty"))
+	assert.True(t, r.URL.Query.Has("flag"))
+	assert.False(t, r.URL.Query.Has("missing"))
+
+	// Test: Target without a query
+	r, err = RequestFromReader(strings.NewReader("GET /coffee HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "/coffee", r.URL.Path)
+	assert.Equal(t, "", r.URL.RawQuery)
+	assert.Empty(t, r.URL.Query)
+
+	// Test: Invalid targets are rejected
+	for _, target := range []string{
+		"coffee",
+		"/coffee#top",
+		"/a%2",
+		"/a%zz",
+		"/a?b=%",
+		"/caf\xc3\xa9",
+		"/a\"b",
+		"/a<b>",
+	} {
+		_, err = RequestFromReader(strings.NewReader("GET " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		assert.ErrorIs(t, err, ErrInvalidTarget, target)
+	}
+
+	// Test: Unescape decodes percent escapes
+	decoded, err := Unescape("%41%62c%2f")
+	require.NoError(t, err)
+	assert.Equal(t, "Abc/", decoded)
+	_, err = Unescape("%4")
+	assert.Error(t, err)
+}
+
+func TestTargetForms(t *testing.T) {
+	parse := func(method, target string) (*Request, error) {
+		return RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	}
+
+	// Test: Origin-form names no host
+	r, err := parse("GET", "/coffee")
+	require.NoError(t, err)
+	assert.Equal(t, OriginForm, r.RequestLine.TargetForm)
+	assert.Equal(t, "", r.RequestLine.Host)
+	assert.Equal(t, "", r.RequestLine.Port)
+
+	// Test: Absolute-form gives the host, port, path and query
+	r, err = parse("GET", "http://example.com:8080/a%20b?q=1")
+	require.NoError(t, err)
+	assert.Equal(t, AbsoluteForm, r.RequestLine.TargetForm)
+	assert.Equal(t, "example.com", r.RequestLine.Host)
+	assert.Equal(t, "8080", r.RequestLine.Port)
+	assert.Equal(t, "/a b", r.URL.Path)
+	assert.Equal(t, "1", r.URL.Query.Get("q"))
+
+	// Test: Absolute-form without a port or path uses the scheme's default and "/"
+	r, err = parse("GET", "https://example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "443", r.RequestLine.Port)
+	assert.Equal(t, "/", r.URL.Path)
+
+	r, err = parse("GET", "http://[::1]?x=y")
+	require.NoError(t, err)
+	assert.Equal(t, "[::1]", r.RequestLine.Host)
+	assert.Equal(t, "80", r.RequestLine.Port)
+	assert.Equal(t, "/", r.URL.Path)
+	assert.Equal(t, "y", r.URL.Query.Get("x"))
+
+	// Test: CONNECT uses authority-form
+	r, err = parse("CONNECT", "example.com:443")
+	require.NoError(t, err)
+	assert.Equal(t, AuthorityForm, r.RequestLine.TargetForm)
+	assert.Equal(t, "example.com", r.RequestLine.Host)
+	assert.Equal(t, "443", r.RequestLine.Port)
+
+	r, err = parse("CONNECT", "[2001:db8::1]:8443")
+	require.NoError(t, err)
+	assert.Equal(t, "[2001:db8::1]", r.RequestLine.Host)
+	assert.Equal(t, "8443", r.RequestLine.Port)
+
+	// Test: OPTIONS may use asterisk-form
+	r, err = parse("OPTIONS", "*")
+	require.NoError(t, err)
+	assert.Equal(t, AsteriskForm, r.RequestLine.TargetForm)
+
+	// Test: Forms used with the wrong method, or malformed, are rejected
+	for _, tc := range []struct{ method, target string }{
+		{"GET", "*"},
+		{"CONNECT", "/"},
+		{"CONNECT", "example.com"},
+		{"CONNECT", "http://example.com:443"},
+		{"GET", "example.com:443"},
+		{"GET", "http://user@example.com/"},
+		{"GET", "http:///path"},
+		{"GET", "http://example.com:http/"},
+		{"GET", "http://[::1/"},
+		{"GET", "1http://example.com/"},
+		{"GET", "http://example.com/#frag"},
+	} {
+		_, err = parse(tc.method, tc.target)
+		assert.ErrorIs(t, err, ErrInvalidTarget, tc.method+" "+tc.target)
+	}
+}
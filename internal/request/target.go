@@ -0,0 +1,269 @@
+package request
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TargetForm is how the request target is written (RFC 9112 3.2).
+type TargetForm int
+
+const (
+	// OriginForm is an absolute path with an optional query, "/search?q=go"
+	OriginForm TargetForm = iota
+	// AbsoluteForm is a full URI, sent to proxies, "http://example.com/search"
+	AbsoluteForm
+	// AuthorityForm is a host and port, only for CONNECT, "example.com:443"
+	AuthorityForm
+	// AsteriskForm is "*", only for a server-wide OPTIONS
+	AsteriskForm
+)
+
+// URL is the path and query of the request target. Requests never carry a
+// fragment. For authority-form and asterisk-form targets, which have no path,
+// it is empty.
+type URL struct {
+	// Path is the percent-decoded path, RawPath the path as it was sent
+	Path    string
+	RawPath string
+	// Query holds the decoded query parameters, RawQuery the query as it was
+	// sent without the "?"
+	Query    Query
+	RawQuery string
+}
+
+// Query maps each query parameter name to its values in the order they appear.
+type Query map[string][]string
+
+// Get returns the first value of the parameter, or an empty string.
+func (q Query) Get(key string) string {
+	if values := q[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (q Query) Has(key string) bool {
+	_, ok := q[key]
+	return ok
+}
+
+// parseRequestTarget works out the form of the request line's target, checks
+// it is allowed for the method, and records the host and port it names.
+func parseRequestTarget(requestLine *RequestLine) (*URL, error) {
+	target, method := requestLine.RequestTarget, requestLine.Method
+
+	switch {
+	case method == "CONNECT":
+		host, port, err := parseAuthority(target)
+		if err != nil || port == "" {
+			return nil, fmt.Errorf("%w: CONNECT needs a host and port: %s", ErrInvalidTarget, target)
+		}
+		requestLine.TargetForm = AuthorityForm
+		requestLine.Host, requestLine.Port = host, port
+		return &URL{Query: Query{}}, nil
+	case target == "*":
+		if method != "OPTIONS" {
+			return nil, fmt.Errorf("%w: only OPTIONS can target *", ErrInvalidTarget)
+		}
+		requestLine.TargetForm = AsteriskForm
+		return &URL{Query: Query{}}, nil
+	case strings.HasPrefix(target, "/"):
+		requestLine.TargetForm = OriginForm
+		return parseTarget(target)
+	}
+
+	// absolute-form: scheme "://" authority [ path-abempty ] [ "?" query ]
+	scheme, rest, found := strings.Cut(target, "://")
+	if !found || !isScheme(scheme) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+	authority, path := rest, "/"
+	if i := strings.IndexAny(rest, "/?"); i != -1 {
+		authority, path = rest[:i], rest[i:]
+		if path[0] == '?' {
+			path = "/" + path
+		}
+	}
+
+	host, port, err := parseAuthority(authority)
+	if err != nil {
+		return nil, err
+	}
+	if port == "" {
+		port = defaultPorts[strings.ToLower(scheme)]
+	}
+
+	url, err := parseTarget(path)
+	if err != nil {
+		return nil, err
+	}
+	requestLine.TargetForm = AbsoluteForm
+	requestLine.Host, requestLine.Port = host, port
+	return url, nil
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+func isScheme(s string) bool {
+	if s == "" || !isLetter(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !isLetter(c) && !('0' <= c && c <= '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// hostChars are the characters of a reg-name or IPv4 address (RFC 3986 3.2.2).
+const hostChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._~!$&'()*+,;=%"
+
+// parseAuthority splits an authority such as "example.com:8080" or
+// "[::1]:443" into its host and port, which is empty if there is none. HTTP
+// targets can't carry userinfo (RFC 9110 4.2.4).
+func parseAuthority(authority string) (host, port string, err error) {
+	invalid := fmt.Errorf("%w: invalid authority %q", ErrInvalidTarget, authority)
+
+	if strings.HasPrefix(authority, "[") {
+		// IP-literal, the colons inside the brackets aren't the port's
+		end := strings.Index(authority, "]")
+		if end < 2 || !validTargetPart(authority[1:end], "0123456789abcdefABCDEF:.") {
+			return "", "", invalid
+		}
+		host, rest := authority[:end+1], authority[end+1:]
+		if rest != "" && !strings.HasPrefix(rest, ":") {
+			return "", "", invalid
+		}
+		port = strings.TrimPrefix(rest, ":")
+		if !validPort(port) {
+			return "", "", invalid
+		}
+		return host, port, nil
+	}
+
+	host, port, _ = strings.Cut(authority, ":")
+	if host == "" || !validTargetPart(host, hostChars) || !validPort(port) {
+		return "", "", invalid
+	}
+	if _, err := Unescape(host); err != nil {
+		return "", "", invalid
+	}
+	return host, port, nil
+}
+
+func validPort(port string) bool {
+	return len(port) <= 5 && validTargetPart(port, "0123456789")
+}
+
+// parseTarget parses an origin-form request target, absolute-path [ "?" query ]
+// (RFC 9112 3.2.1).
+func parseTarget(target string) (*URL, error) {
+	if !strings.HasPrefix(target, "/") {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	if !validTargetPart(rawPath, pathChars) || !validTargetPart(rawQuery, queryChars) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+
+	path, err := Unescape(rawPath)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+	query, err := parseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
+
+	return &URL{
+		Path:     path,
+		RawPath:  rawPath,
+		Query:    query,
+		RawQuery: rawQuery,
+	}, nil
+}
+
+// pathChars are the characters allowed as is in a path, pchar and "/" (RFC
+// 3986 3.3). queryChars adds "?" (RFC 3986 3.4). "%" starts an escape.
+const (
+	pathChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-._~!$&'()*+,;=:@/%"
+	queryChars = pathChars + "?"
+)
+
+func validTargetPart(s, allowed string) bool {
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune(allowed, rune(s[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Unescape decodes the percent-encoded octets in s, such as "%20" for a space.
+func Unescape(s string) (string, error) {
+	if !strings.Contains(s, "%") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			return "", fmt.Errorf("invalid escape in %q", s)
+		}
+		b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// parseQuery decodes a query of name=value pairs separated by "&", where "+"
+// stands for a space as in HTML forms.
+func parseQuery(rawQuery string) (Query, error) {
+	query := make(Query)
+	for _, pair := range strings.Split(rawQuery, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		name, err := Unescape(strings.ReplaceAll(name, "+", " "))
+		if err != nil {
+			return nil, err
+		}
+		value, err = Unescape(strings.ReplaceAll(value, "+", " "))
+		if err != nil {
+			return nil, err
+		}
+		query[name] = append(query[name], value)
+	}
+	return query, nil
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,18 @@
+package response
+
+import "errors"
+
+// Errors returned while writing a response. Some are wrapped with the
+// offending field name, so compare them with errors.Is.
+var (
+	ErrBodyNotAllowed   = errors.New("response status does not allow a body")
+	ErrNotInformational = errors.New("status is not an interim 1xx status")
+
+	ErrContentLength      = errors.New("body length does not match the Content-Length")
+	ErrBodyBuffered       = errors.New("status line written after Write buffered some of the body")
+	ErrIncompleteResponse = errors.New("response ended before its headers were written")
+
+	ErrTrailersNotChunked = errors.New("trailers require a chunked body")
+	ErrForbiddenTrailer   = errors.New("field not allowed in trailers")
+	ErrUndeclaredTrailer  = errors.New("trailer field not declared in the Trailer header")
+)
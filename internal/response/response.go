@@ -5,14 +5,7 @@ import (
 	"httpfromtcp/internal/headers"
 	"io"
 	"strconv"
-)
-
-type StatusCode int
-
-const (
-	StatusOK          StatusCode = 200
-	StatusNotFound    StatusCode = 400
-	StatusServerError StatusCode = 500
+	"strings"
 )
 
 type writerState int
@@ -25,9 +18,50 @@ const (
 	writeDone
 )
 
+// bufferSize is how much of a body Write holds back so it can be sent with a
+// Content-Length. Bodies that outgrow it are sent chunked.
+const bufferSize = 4 << 10
+
+// Writer writes a response in one of two ways. The Write* methods put each part
+// of the message on the wire as they are called. Header, WriteHeader and Write
+// instead buffer the response and pick its framing, and the server sends what
+// is left with Finish once the handler returns.
 type Writer struct {
-	Writer      io.Writer
-	writerState writerState
+	Writer          io.Writer
+	writerState     writerState
+	closeConnection bool
+
+	header  *headers.Headers
+	status  StatusCode
+	buffer  []byte
+	chunked bool
+
+	// length is the Content-Length sent, if lengthSet, and sent how much of
+	// the body has gone out against it
+	length    int
+	lengthSet bool
+	sent      int
+
+	// trailers are the declared trailer names, trailer the values Finish sends
+	trailers []string
+	trailer  *headers.Headers
+
+	// head responses have their body counted for the Content-Length, but
+	// never sent
+	head       bool
+	headLength int
+
+	// written counts the body bytes the handler has written
+	written int
+
+	// filters transform what Write is given, see WrapBody
+	filters []io.WriteCloser
+	wrapped bool
+
+	// http10 clients can't decode chunked bodies, so a chunked response is
+	// sent to them without its framing, dechunked, and ended by closing
+	http10  bool
+	dechunk bool
 }
 
 func MakeWriter(writer io.Writer) *Writer {
@@ -37,42 +71,119 @@ func MakeWriter(writer io.Writer) *Writer {
 	}
 }
 
+// WriteInformational sends an interim 1xx response with the fields in h, which
+// may be nil, ahead of the final one. It can be called any number of times
+// before the final status line, for instance for 103 Early Hints with Link
+// fields. 101 Switching Protocols ends the exchange, so it is a final status
+// written with WriteStatusLine. HTTP/1.0 clients don't know interim responses,
+// so nothing is sent to them.
+func (w *Writer) WriteInformational(statusCode StatusCode, h *headers.Headers) error {
+	if statusCode < 100 || statusCode > 199 || statusCode == StatusSwitchingProtocols {
+		return fmt.Errorf("%w: %d", ErrNotInformational, statusCode)
+	}
+	if w.writerState != writeStatus {
+		return fmt.Errorf("cannot write an interim response after the status line")
+	}
+	if w.http10 {
+		return nil
+	}
+
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Writer.Write(line); err != nil {
+		return err
+	}
+	if h != nil {
+		if err := WriteHeaders(w.Writer, h); err != nil {
+			return err
+		}
+	}
+	_, err = w.Writer.Write([]byte("\r\n"))
+	return err
+}
+
+// WriteStatusLine starts the response with its status line. It fails once
+// Write has buffered some of the body, which would otherwise be lost.
 func (w *Writer) WriteStatusLine(statusCode StatusCode) error {
+	if len(w.buffer) > 0 || w.headLength > 0 {
+		return ErrBodyBuffered
+	}
+	return w.writeStatusLine(statusCode)
+}
+
+func (w *Writer) writeStatusLine(statusCode StatusCode) error {
 	if w.writerState != writeStatus {
 		return fmt.Errorf("cannot write to status line")
 	}
 
-	var err error
-
-	switch statusCode {
-	case StatusOK:
-		_, err = w.Writer.Write(statusBytes(200, "OK"))
-	case StatusNotFound:
-		_, err = w.Writer.Write(statusBytes(400, "Not Found"))
-	case StatusServerError:
-		_, err = w.Writer.Write(statusBytes(500, "Server Error"))
-	default:
-		_, err = w.Writer.Write(statusBytes(500, ""))
+	line, err := statusLine(statusCode)
+	if err != nil {
+		return err
 	}
 
+	_, err = w.Writer.Write(line)
 	if err != nil {
 		return err
 	}
+	w.status = statusCode
 	w.writerState = writeHeaders
 	return nil
 }
 
-func (w *Writer) WriteHeaders(headers headers.Headers) error {
+func (w *Writer) WriteHeaders(h *headers.Headers) error {
 	if w.writerState != writeHeaders {
 		return fmt.Errorf("cannot write headers")
 	}
-	for key, value := range headers {
-		_, err := w.Writer.Write([]byte(key + ": " + value + "\r\n"))
+	connection, hasConnection := h.Get("Connection")
+	if hasConnection && headers.HasToken(connection, "close") {
+		w.closeConnection = true
+	}
+	if w.status < 200 || w.status == StatusNoContent {
+		// these responses can't have a body, so no framing either (RFC 9110 8.6)
+		h = withoutFields(h, "Content-Length", "Transfer-Encoding")
+	}
+	transferEncoding, _ := h.Get("Transfer-Encoding")
+	w.chunked = headers.HasToken(transferEncoding, "chunked")
+	contentLength, hasLength := h.Get("Content-Length")
+	w.length, w.lengthSet = 0, false
+	if n, err := strconv.Atoi(contentLength); hasLength && !w.chunked && err == nil {
+		w.length, w.lengthSet = n, true
+	}
+	missing, err := w.declareTrailerHeader(h)
+	if err != nil {
+		return err
+	}
+	if w.http10 && w.chunked {
+		h = withoutFields(h, "Transfer-Encoding", "Trailer")
+		w.dechunk = true
+		w.closeConnection = true
+		missing = nil
+	}
+	if err := WriteHeaders(w.Writer, h); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		_, err := w.Writer.Write([]byte("Trailer: " + strings.Join(missing, ", ") + "\r\n"))
 		if err != nil {
 			return err
 		}
 	}
-	_, err := w.Writer.Write([]byte("\r\n"))
+	// tell the client when the server is going to close after this response,
+	// or that it won't for HTTP/1.0 clients that expect it to
+	if w.closeConnection && !hasConnection {
+		_, err := w.Writer.Write([]byte("Connection: close\r\n"))
+		if err != nil {
+			return err
+		}
+	} else if w.http10 && !w.closeConnection && !hasConnection {
+		_, err := w.Writer.Write([]byte("Connection: keep-alive\r\n"))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Writer.Write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
@@ -81,11 +192,334 @@ func (w *Writer) WriteHeaders(headers headers.Headers) error {
 	return nil
 }
 
+// Header returns the headers sent with the response by WriteHeader and Write.
+// Changes made after the headers are sent have no effect.
+func (w *Writer) Header() *headers.Headers {
+	if w.header == nil {
+		w.header = headers.NewHeaders()
+	}
+	return w.header
+}
+
+// WriteHeader sets the response status code. It is sent along with the headers
+// once the body is flushed, and only the first call counts.
+func (w *Writer) WriteHeader(statusCode StatusCode) {
+	if w.writerState != writeStatus || w.status != 0 {
+		return
+	}
+	w.status = statusCode
+}
+
+// Write adds p to the body, implying a 200 status if WriteHeader wasn't called.
+// The body is buffered until it outgrows bufferSize or Flush is called, then
+// the headers are sent and the body streamed, chunked unless the handler set a
+// Content-Length.
+func (w *Writer) Write(p []byte) (int, error) {
+	if len(w.filters) > 0 {
+		return w.filters[len(w.filters)-1].Write(p)
+	}
+	return w.countedWrite(p)
+}
+
+// countedWrite adds p to the body, counting it for BytesWritten.
+func (w *Writer) countedWrite(p []byte) (int, error) {
+	n, err := w.write(p)
+	w.written += n
+	return n, err
+}
+
+// WrapBody routes the body given to Write through the writer wrap returns,
+// which writes what it makes of it to the io.Writer it is passed. This lets
+// middleware transform the body, to compress it for instance. Each call wraps
+// the writers of the earlier ones, and Finish closes them, the last one first,
+// so they can flush what they hold. As the length of the body changes, any
+// Content-Length the handler sets is dropped. WrapBody must be called before
+// the body is written, and doesn't affect WriteBody or WriteChunkedBody.
+func (w *Writer) WrapBody(wrap func(io.Writer) io.WriteCloser) error {
+	if w.writerState != writeStatus || len(w.buffer) > 0 || w.headLength > 0 {
+		return fmt.Errorf("cannot wrap the body once it is written")
+	}
+
+	var inner io.Writer = writerFunc(w.filteredWrite)
+	if len(w.filters) > 0 {
+		inner = w.filters[len(w.filters)-1]
+	}
+	w.filters = append(w.filters, wrap(inner))
+	w.wrapped = true
+	return nil
+}
+
+// closeFilters closes the writers set with WrapBody, flushing what they hold
+// into the body.
+func (w *Writer) closeFilters() error {
+	for len(w.filters) > 0 {
+		last := w.filters[len(w.filters)-1]
+		w.filters = w.filters[:len(w.filters)-1]
+		if err := last.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filteredWrite adds what the WrapBody writers make of the body to it. A
+// status without a body discards it, so a compressor's header or footer doesn't
+// fail the response.
+func (w *Writer) filteredWrite(p []byte) (int, error) {
+	if bodyForbidden(w.status) {
+		return len(p), nil
+	}
+	return w.countedWrite(p)
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (w *Writer) write(p []byte) (int, error) {
+	if w.writerState > writeBody {
+		return 0, fmt.Errorf("cannot write body")
+	}
+	if bodyForbidden(w.status) {
+		return 0, ErrBodyNotAllowed
+	}
+	if w.head {
+		w.headLength += len(p)
+		return len(p), nil
+	}
+
+	switch w.writerState {
+	case writeStatus:
+		w.buffer = append(w.buffer, p...)
+		if len(w.buffer) > bufferSize {
+			if err := w.Flush(); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	case writeBody:
+		// an empty chunk would end the body
+		if len(p) == 0 {
+			return 0, nil
+		}
+		if w.chunked {
+			return w.writeChunk(p)
+		}
+		if err := w.countLength(len(p)); err != nil {
+			return 0, err
+		}
+		return w.bodyWriter().Write(p)
+	default:
+		return 0, fmt.Errorf("cannot write body")
+	}
+}
+
+// Flush sends the status line, the headers and whatever body is buffered. The
+// rest of the body is written as it comes.
+func (w *Writer) Flush() error {
+	if w.writerState != writeStatus {
+		return nil
+	}
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+
+	h := w.Header()
+	if w.wrapped {
+		h.Del("Content-Length")
+	}
+	if _, ok := h.Get("Content-Length"); !ok && !bodyForbidden(w.status) {
+		if w.http10 {
+			// the body runs until the connection closes
+			w.CloseConnection()
+		} else {
+			h.Set("Transfer-Encoding", "chunked")
+		}
+	}
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	buffer := w.buffer
+	w.buffer = nil
+	if !w.bodyAllowed() {
+		return nil
+	}
+	_, err := w.write(buffer)
+	return err
+}
+
+// Finish completes the response once the handler has returned. A body that
+// was never flushed is sent whole with its Content-Length, a chunked body is
+// ended. Responses written with WriteStatusLine and WriteHeaders are finished
+// only if they were sent chunked, and are an error if the headers are missing.
+func (w *Writer) Finish() error {
+	if err := w.closeFilters(); err != nil {
+		return err
+	}
+
+	switch w.writerState {
+	case writeStatus:
+		h := w.Header()
+		if w.wrapped {
+			h.Del("Content-Length")
+		}
+		_, hasLength := h.Get("Content-Length")
+		_, hasEncoding := h.Get("Transfer-Encoding")
+		_, hasTrailer := h.Get("Trailer")
+		if w.trailer != nil && w.trailer.Len() > 0 && len(w.trailers) == 0 && !hasTrailer {
+			// nothing declares the trailers set, so they could only be dropped
+			var name string
+			w.trailer.Range(func(key, _ string) bool {
+				name = key
+				return false
+			})
+			return fmt.Errorf("%w: %s", ErrUndeclaredTrailer, name)
+		}
+		if hasLength || hasEncoding || hasTrailer || len(w.trailers) > 0 {
+			// the handler chose the framing itself, or trailers need chunking
+			if err := w.Flush(); err != nil {
+				return err
+			}
+			return w.Finish()
+		}
+
+		if w.status == 0 {
+			w.status = StatusOK
+		}
+		if !bodyForbidden(w.status) {
+			length := len(w.buffer)
+			if w.head {
+				length = w.headLength
+			}
+			h.Set("Content-Length", strconv.Itoa(length))
+		}
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+		buffer := w.buffer
+		w.buffer = nil
+		_, err := w.writeBody(buffer)
+		return err
+	case writeHeaders:
+		// the status line went out without the headers, which can't be
+		// made up for
+		return ErrIncompleteResponse
+	case writeBody:
+		if !w.bodyAllowed() {
+			w.writerState = writeDone
+			return nil
+		}
+		if !w.chunked {
+			w.writerState = writeTrailers
+			if err := w.checkLength(); err != nil {
+				return err
+			}
+			if w.trailer != nil && w.trailer.Len() > 0 && !w.http10 {
+				return ErrTrailersNotChunked
+			}
+			return nil
+		}
+		if _, err := w.WriteChunkedBodyDone(); err != nil {
+			return err
+		}
+		return w.finishTrailers()
+	case writeTrailers:
+		if w.chunked {
+			return w.finishTrailers()
+		}
+		return w.checkLength()
+	}
+	return nil
+}
+
+// countLength counts n more body bytes against the Content-Length sent,
+// failing if they would go past it. Either way the client would misread the
+// next response, so the connection is closed after a mismatch.
+func (w *Writer) countLength(n int) error {
+	if !w.lengthSet || !w.bodyAllowed() {
+		return nil
+	}
+	if w.sent+n > w.length {
+		w.closeConnection = true
+		return fmt.Errorf("%w: %d bytes written past a Content-Length of %d", ErrContentLength, w.sent+n-w.length, w.length)
+	}
+	w.sent += n
+	return nil
+}
+
+// checkLength fails if less of the body was written than the Content-Length
+// sent promised.
+func (w *Writer) checkLength() error {
+	if !w.lengthSet || !w.bodyAllowed() || w.sent == w.length {
+		return nil
+	}
+	w.closeConnection = true
+	return fmt.Errorf("%w: %d of %d bytes written", ErrContentLength, w.sent, w.length)
+}
+
+// DiscardBody makes the writer send the headers of the response, Content-Length
+// included, without its body, as the answer to a HEAD request.
+func (w *Writer) DiscardBody() {
+	w.head = true
+}
+
+// bodyAllowed reports whether body bytes go on the wire.
+func (w *Writer) bodyAllowed() bool {
+	return !w.head && !bodyForbidden(w.status)
+}
+
+// bodyWriter is where the body and its chunked framing are written, discarding
+// them when the response must not have a body.
+func (w *Writer) bodyWriter() io.Writer {
+	if !w.bodyAllowed() {
+		return io.Discard
+	}
+	return w.Writer
+}
+
+// framingWriter is where chunk sizes and trailers are written, discarding them
+// when there is no body or it is sent dechunked.
+func (w *Writer) framingWriter() io.Writer {
+	if w.dechunk {
+		return io.Discard
+	}
+	return w.bodyWriter()
+}
+
+// UseHTTP10 adapts the response to an HTTP/1.0 client. Bodies that would be
+// chunked are sent as they are and ended by closing the connection, trailers
+// are dropped, and a connection kept open is announced with keep-alive.
+func (w *Writer) UseHTTP10() {
+	w.http10 = true
+}
+
+func (w *Writer) writeHeader() error {
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	if err := w.writeStatusLine(w.status); err != nil {
+		return err
+	}
+	return w.WriteHeaders(w.Header())
+}
+
 func (w *Writer) WriteBody(p []byte) (int, error) {
+	n, err := w.writeBody(p)
+	w.written += n
+	return n, err
+}
+
+func (w *Writer) writeBody(p []byte) (int, error) {
 	if w.writerState != writeBody {
 		return 0, fmt.Errorf("cannot write body")
 	}
-	i, err := w.Writer.Write(p)
+	if err := w.countLength(len(p)); err != nil {
+		return 0, err
+	}
+	i, err := w.bodyWriter().Write(p)
 	if err != nil {
 		return 0, err
 	}
@@ -95,23 +529,34 @@ func (w *Writer) WriteBody(p []byte) (int, error) {
 }
 
 func (w *Writer) WriteChunkedBody(p []byte) (int, error) {
+	n, err := w.writeChunk(p)
+	w.written += n
+	return n, err
+}
+
+func (w *Writer) writeChunk(p []byte) (int, error) {
 	if w.writerState != writeBody {
 		return 0, fmt.Errorf("cannot write body")
 	}
 
 	lengthLine := fmt.Sprintf("%x\r\n", len(p))
 
-	_, err := w.Writer.Write([]byte(lengthLine))
+	_, err := w.framingWriter().Write([]byte(lengthLine))
 	if err != nil {
 		return 0, err
 	}
 
-	j, err := w.Writer.Write(append(p, []byte("\r\n")...))
+	j, err := w.bodyWriter().Write(p)
 	if err != nil {
 		return 0, err
 	}
 
-	return j - 2, nil
+	_, err = w.framingWriter().Write([]byte("\r\n"))
+	if err != nil {
+		return 0, err
+	}
+
+	return j, nil
 }
 
 func (w *Writer) WriteChunkedBodyDone() (int, error) {
@@ -119,7 +564,7 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 		return 0, fmt.Errorf("cannot write body")
 	}
 
-	i, err := w.Writer.Write([]byte("0\r\n"))
+	i, err := w.framingWriter().Write([]byte("0\r\n"))
 	if err != nil {
 		return 0, err
 	}
@@ -128,17 +573,19 @@ func (w *Writer) WriteChunkedBodyDone() (int, error) {
 	return i, nil
 }
 
-func (w *Writer) WriteTrailers(h headers.Headers) error {
+// WriteTrailers ends a chunked body with trailer fields. Each field must have
+// been declared, either with DeclareTrailers or in a Trailer header.
+func (w *Writer) WriteTrailers(h *headers.Headers) error {
 	if w.writerState != writeTrailers {
 		return fmt.Errorf("cannot write trailers")
 	}
-	for key, value := range h {
-		_, err := w.Writer.Write([]byte(key + ": " + value + "\r\n"))
-		if err != nil {
-			return err
-		}
+	if err := w.checkTrailers(h); err != nil {
+		return err
 	}
-	_, err := w.Writer.Write([]byte("\r\n"))
+	if err := WriteHeaders(w.framingWriter(), h); err != nil {
+		return err
+	}
+	_, err := w.framingWriter().Write([]byte("\r\n"))
 	if err != nil {
 		return err
 	}
@@ -148,56 +595,98 @@ func (w *Writer) WriteTrailers(h headers.Headers) error {
 }
 
 func (w *Writer) WriteDone() error {
-	_, err := w.Writer.Write([]byte("\r\n"))
-	return err
+	// WriteTrailers already ended the trailer section
+	if w.writerState == writeDone {
+		return nil
+	}
+	_, err := w.framingWriter().Write([]byte("\r\n"))
+	if err != nil {
+		return err
+	}
+
+	w.writerState = writeDone
+	return nil
+}
+
+// Status returns the status code of the response, StatusOK if it hasn't been
+// set yet since that is what will be sent.
+func (w *Writer) Status() StatusCode {
+	if w.status == 0 {
+		return StatusOK
+	}
+	return w.status
+}
+
+// BytesWritten returns how many body bytes the handler has written, before any
+// chunked framing. The body of a HEAD response counts though it isn't sent.
+func (w *Writer) BytesWritten() int {
+	return w.written
+}
+
+// CloseConnection marks the connection to be closed once this response is
+// written. It must be called before WriteHeaders for the client to be told.
+func (w *Writer) CloseConnection() {
+	w.closeConnection = true
+}
+
+// StatusLineWritten reports whether the response has been started.
+func (w *Writer) StatusLineWritten() bool {
+	return w.writerState != writeStatus
+}
+
+// ShouldClose reports whether the connection can't be reused after this
+// response, either because a close was requested or the response is incomplete.
+func (w *Writer) ShouldClose() bool {
+	return w.closeConnection || w.writerState < writeTrailers
 }
 
 func (w *Writer) WriteError(err error) {
-	headers := GetDefaultHeaders(0)
 	body := []byte(fmt.Sprintf("%v", err))
-	w.WriteStatusLine(StatusServerError)
-	headers["content-length"] = strconv.Itoa(len(body))
+	headers := GetDefaultHeaders(len(body))
+	w.WriteStatusLine(StatusInternalServerError)
 	w.WriteHeaders(headers)
 	w.WriteBody(body)
 }
 
 func WriteStatusLine(w io.Writer, statusCode StatusCode) error {
-	switch statusCode {
-	case StatusOK:
-		_, err := w.Write(statusBytes(200, "OK"))
-		return err
-	case StatusNotFound:
-		_, err := w.Write(statusBytes(400, "Not Found"))
-		return err
-	case StatusServerError:
-		_, err := w.Write(statusBytes(500, "Server Error"))
-		return err
-	default:
-		_, err := w.Write(statusBytes(500, ""))
+	line, err := statusLine(statusCode)
+	if err != nil {
 		return err
 	}
-}
 
-func statusBytes(statusCode int, reason string) []byte {
-	codeString := strconv.Itoa(statusCode)
-	return []byte("HTTP/1.1 " + codeString + " " + reason + "\r\n")
+	_, err = w.Write(line)
+	return err
 }
 
-func GetDefaultHeaders(contentLen int) headers.Headers {
-	return headers.Headers{
-		"content-length": strconv.Itoa(contentLen),
-		"connection":     "close",
-		"content-type":   "text/plain",
-	}
+func GetDefaultHeaders(contentLen int) *headers.Headers {
+	h := headers.NewHeaders()
+	h.Set("content-length", strconv.Itoa(contentLen))
+	h.Set("content-type", "text/plain")
+	return h
 }
 
-func WriteHeaders(w io.Writer, headers headers.Headers) error {
-	for key, value := range headers {
-		_, err := w.Write([]byte(key + ": " + value + "\r\n"))
-		if err != nil {
-			return err
+// withoutFields returns a copy of h without the named fields.
+func withoutFields(h *headers.Headers, names ...string) *headers.Headers {
+	stripped := headers.NewHeaders()
+	h.RangeRaw(func(key, value string) bool {
+		for _, name := range names {
+			if strings.EqualFold(key, name) {
+				return true
+			}
 		}
-	}
+		stripped.AddRaw(key, value)
+		return true
+	})
+	return stripped
+}
 
-	return nil
+// WriteHeaders writes each field line in order, without the empty line that
+// ends the section. Names are written with the spelling they were given.
+func WriteHeaders(w io.Writer, h *headers.Headers) error {
+	var err error
+	h.RangeRaw(func(key, value string) bool {
+		_, err = w.Write([]byte(key + ": " + value + "\r\n"))
+		return err == nil
+	})
+	return err
 }
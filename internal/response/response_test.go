@@ -0,0 +1,533 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"httpfromtcp/internal/headers"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusLine(t *testing.T) {
+	// Test: Registered codes carry their reason phrase
+	cases := map[StatusCode]string{
+		StatusOK:                    "HTTP/1.1 200 OK\r\n",
+		StatusNotFound:              "HTTP/1.1 404 Not Found\r\n",
+		StatusRequestEntityTooLarge: "HTTP/1.1 413 Content Too Large\r\n",
+		StatusInternalServerError:   "HTTP/1.1 500 Internal Server Error\r\n",
+		StatusEarlyHints:            "HTTP/1.1 103 Early Hints\r\n",
+	}
+	for code, want := range cases {
+		var buf bytes.Buffer
+		require.NoError(t, WriteStatusLine(&buf, code))
+		assert.Equal(t, want, buf.String())
+	}
+
+	// Test: Unregistered codes keep their number with an empty reason
+	var buf bytes.Buffer
+	require.NoError(t, WriteStatusLine(&buf, 299))
+	assert.Equal(t, "HTTP/1.1 299 \r\n", buf.String())
+	assert.Equal(t, "", StatusText(299))
+
+	// Test: Writer uses the same status line
+	buf.Reset()
+	w := MakeWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(418))
+	assert.Equal(t, "HTTP/1.1 418 \r\n", buf.String())
+
+	// Test: Codes outside 100-599 are rejected
+	buf.Reset()
+	assert.Error(t, WriteStatusLine(&buf, 99))
+	assert.Error(t, WriteStatusLine(&buf, 600))
+	assert.Error(t, MakeWriter(&buf).WriteStatusLine(1000))
+	assert.Empty(t, buf.String())
+}
+
+func TestWriter(t *testing.T) {
+	// Test: Small body is buffered and sent with its Content-Length
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(StatusCreated)
+	w.WriteHeader(StatusOK)
+	n, err := w.Write([]byte("hello "))
+	require.NoError(t, err)
+	assert.Equal(t, 6, n)
+	_, err = w.Write([]byte("world"))
+	require.NoError(t, err)
+	assert.False(t, w.StatusLineWritten())
+	assert.Empty(t, buf.String())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\nhello world", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Handler that writes nothing sends an empty 200
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", buf.String())
+
+	// Test: Body larger than the buffer switches to chunked
+	buf.Reset()
+	w = MakeWriter(&buf)
+	large := bytes.Repeat([]byte("a"), bufferSize+1)
+	_, err = w.Write(large)
+	require.NoError(t, err)
+	assert.True(t, w.StatusLineWritten())
+	_, err = w.Write([]byte("bc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1001\r\n"+string(large)+"\r\n2\r\nbc\r\n0\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Flush sends the headers and buffered body right away
+	buf.Reset()
+	w = MakeWriter(&buf)
+	_, err = w.Write([]byte("first"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n", buf.String())
+	_, err = w.Write(nil)
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nfirst\r\n0\r\n\r\n", buf.String())
+
+	// Test: Content-Length set by the handler is kept and the body isn't chunked
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.Header().Set("Content-Length", "3")
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nabc", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Write after Finish fails
+	_, err = w.Write([]byte("more"))
+	assert.Error(t, err)
+
+	// Test: Finish ends a chunked body written with the low-level methods
+	buf.Reset()
+	w = MakeWriter(&buf)
+	h := GetDefaultHeaders(0)
+	h.Del("Content-Length")
+	h.Set("Transfer-Encoding", "chunked")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", buf.String())
+
+	// Test: Status line can't follow a buffered body
+	buf.Reset()
+	w = MakeWriter(&buf)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.WriteStatusLine(StatusOK), ErrBodyBuffered)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\n\r\nabc", buf.String())
+
+	// Test: Body must match the Content-Length the handler set
+	w = MakeWriter(io.Discard)
+	w.Header().Set("Content-Length", "10")
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.Finish(), ErrContentLength)
+	assert.True(t, w.ShouldClose())
+
+	w = MakeWriter(io.Discard)
+	w.Header().Set("Content-Length", "2")
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("hello"))
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.True(t, w.ShouldClose())
+
+	w = MakeWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(2)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.ErrorIs(t, err, ErrContentLength)
+	assert.True(t, w.ShouldClose())
+
+	w = MakeWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	_, err = w.WriteBody([]byte("hello"))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.Finish(), ErrContentLength)
+	assert.True(t, w.ShouldClose())
+
+	// Test: HEAD responses keep the Content-Length without a body
+	w = MakeWriter(io.Discard)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(10)))
+	require.NoError(t, w.Finish())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Finish fails for a status line without headers
+	w = MakeWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.ErrorIs(t, w.Finish(), ErrIncompleteResponse)
+	assert.True(t, w.ShouldClose())
+}
+
+func TestTrailers(t *testing.T) {
+	chunkedHeaders := func() *headers.Headers {
+		h := headers.NewHeaders()
+		h.Set("Transfer-Encoding", "chunked")
+		return h
+	}
+
+	// Test: Declared trailers are listed in the Trailer header and sent
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	require.NoError(t, w.DeclareTrailers("x-checksum"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders()))
+	_, err := w.WriteChunkedBody([]byte("abc"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailers := headers.NewHeaders()
+	trailers.Set("X-Checksum", "123")
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n3\r\nabc\r\n0\r\nX-Checksum: 123\r\n\r\n", buf.String())
+
+	// Test: Trailers listed in a Trailer header written by the handler are declared
+	buf.Reset()
+	w = MakeWriter(&buf)
+	h := chunkedHeaders()
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	require.NoError(t, w.WriteTrailers(trailers))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n0\r\nX-Checksum: 123\r\n\r\n", buf.String())
+
+	// Test: Undeclared trailer is rejected before anything is written
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	written := buf.Len()
+	err = w.WriteTrailers(trailers)
+	assert.ErrorIs(t, err, ErrUndeclaredTrailer)
+	assert.Equal(t, written, buf.Len())
+
+	// Test: Forbidden trailer fields are rejected
+	buf.Reset()
+	w = MakeWriter(&buf)
+	assert.ErrorIs(t, w.DeclareTrailers("content-length"), ErrForbiddenTrailer)
+	h = chunkedHeaders()
+	h.Set("Trailer", "X-Checksum, Host")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.ErrorIs(t, w.WriteHeaders(h), ErrForbiddenTrailer)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", buf.String())
+
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(chunkedHeaders()))
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	forbidden := headers.NewHeaders()
+	forbidden.Set("Host", "example.com")
+	assert.ErrorIs(t, w.WriteTrailers(forbidden), ErrForbiddenTrailer)
+
+	// Test: Trailers after a body that wasn't chunked are rejected
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.DeclareTrailers("X-Checksum"))
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, w.WriteTrailers(trailers), ErrTrailersNotChunked)
+
+	// Test: Declaring trailers after the headers are written fails
+	assert.Error(t, w.DeclareTrailers("X-Other"))
+
+	// Test: Buffered response with declared trailers is chunked and sends them
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.DeclareTrailers("X-Checksum"))
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	w.Trailer().Set("X-Checksum", "123")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n3\r\nabc\r\n0\r\nX-Checksum: 123\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Buffered response with trailers listed in its Trailer header sends them
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.Header().Set("Trailer", "X-Checksum")
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	w.Trailer().Set("X-Checksum", "123")
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTrailer: X-Checksum\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-Checksum: 123\r\n\r\n", buf.String())
+
+	// Test: Buffered response with undeclared trailers is rejected before anything is written
+	buf.Reset()
+	w = MakeWriter(&buf)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	w.Trailer().Set("X-Checksum", "123")
+	assert.ErrorIs(t, w.Finish(), ErrUndeclaredTrailer)
+	assert.Empty(t, buf.String())
+}
+
+func TestBodySuppression(t *testing.T) {
+	// Test: HEAD response has the Content-Length of the body but no body
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	w.DiscardBody()
+	n, err := w.Write(bytes.Repeat([]byte("a"), bufferSize+10))
+	require.NoError(t, err)
+	assert.Equal(t, bufferSize+10, n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 4106\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: HEAD response written with the low-level methods drops the body
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.DiscardBody()
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	n, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 3\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+
+	// Test: HEAD response to a chunked body has no chunks
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.DiscardBody()
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: 204 response refuses a body and gets no Content-Length
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.WriteHeader(StatusNoContent)
+	_, err = w.Write([]byte("abc"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Framing headers written for a 204 are dropped, and so is the body
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.WriteStatusLine(StatusNoContent))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(3)))
+	_, err = w.WriteBody([]byte("abc"))
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 204 No Content\r\nContent-Type: text/plain\r\n\r\n", buf.String())
+
+	// Test: 304 response keeps a Content-Length set by the handler but sends no body
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.Header().Set("Content-Length", "10")
+	w.WriteHeader(StatusNotModified)
+	_, err = w.Write([]byte("abc"))
+	assert.ErrorIs(t, err, ErrBodyNotAllowed)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n", buf.String())
+	assert.False(t, w.ShouldClose())
+}
+
+func TestWriterObservation(t *testing.T) {
+	// Test: Status defaults to 200 and follows WriteHeader and WriteStatusLine
+	w := MakeWriter(io.Discard)
+	assert.Equal(t, StatusOK, w.Status())
+	w.WriteHeader(StatusNotFound)
+	assert.Equal(t, StatusNotFound, w.Status())
+
+	w = MakeWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(StatusAccepted))
+	assert.Equal(t, StatusAccepted, w.Status())
+
+	// Test: Body bytes are counted once, whether buffered, flushed or chunked
+	w = MakeWriter(io.Discard)
+	_, err := w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("de"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 5, w.BytesWritten())
+
+	w = MakeWriter(io.Discard)
+	_, err = w.Write([]byte("abc"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, 3, w.BytesWritten())
+
+	w = MakeWriter(io.Discard)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(GetDefaultHeaders(4)))
+	_, err = w.WriteBody([]byte("abcd"))
+	require.NoError(t, err)
+	assert.Equal(t, 4, w.BytesWritten())
+}
+
+func TestHTTP10(t *testing.T) {
+	// Test: Buffered body keeps its Content-Length and the connection open
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	w.UseHTTP10()
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nConnection: keep-alive\r\n\r\nhello", buf.String())
+	assert.False(t, w.ShouldClose())
+
+	// Test: Flushed body without a length is ended by closing
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.UseHTTP10()
+	_, err = w.Write([]byte("hel"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	_, err = w.Write([]byte("lo"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", buf.String())
+	assert.True(t, w.ShouldClose())
+
+	// Test: Chunked writes are sent dechunked and trailers dropped
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.UseHTTP10()
+	h := headers.NewHeaders()
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Trailer", "X-Checksum")
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	require.NoError(t, w.WriteHeaders(h))
+	n, err := w.WriteChunkedBody([]byte("hel"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	_, err = w.WriteChunkedBody([]byte("lo"))
+	require.NoError(t, err)
+	_, err = w.WriteChunkedBodyDone()
+	require.NoError(t, err)
+	trailer := headers.NewHeaders()
+	trailer.Set("X-Checksum", "abc")
+	require.NoError(t, w.WriteTrailers(trailer))
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nhello", buf.String())
+	assert.True(t, w.ShouldClose())
+}
+
+func TestInformational(t *testing.T) {
+	// Test: Interim responses come before the final one
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	require.NoError(t, w.WriteInformational(StatusContinue, nil))
+	hints := headers.NewHeaders()
+	hints.Set("Link", "</style.css>; rel=preload; as=style")
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n\r\n"+
+		"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload; as=style\r\n\r\n"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello", buf.String())
+	assert.Equal(t, StatusOK, w.Status())
+
+	// Test: Only interim statuses before the final status line
+	w = MakeWriter(io.Discard)
+	assert.ErrorIs(t, w.WriteInformational(StatusOK, nil), ErrNotInformational)
+	assert.ErrorIs(t, w.WriteInformational(StatusSwitchingProtocols, nil), ErrNotInformational)
+	require.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.Error(t, w.WriteInformational(StatusContinue, nil))
+
+	// Test: HTTP/1.0 clients get no interim responses
+	buf.Reset()
+	w = MakeWriter(&buf)
+	w.UseHTTP10()
+	require.NoError(t, w.WriteInformational(StatusEarlyHints, hints))
+	assert.Empty(t, buf.String())
+}
+
+// upperCaser uppercases what it is given, holding it back until it is closed.
+type upperCaser struct {
+	out  io.Writer
+	held []byte
+}
+
+func (u *upperCaser) Write(p []byte) (int, error) {
+	u.held = append(u.held, bytes.ToUpper(p)...)
+	return len(p), nil
+}
+
+func (u *upperCaser) Close() error {
+	_, err := u.out.Write(u.held)
+	return err
+}
+
+type suffixer struct {
+	io.Writer
+}
+
+func (s suffixer) Close() error {
+	_, err := s.Write([]byte("!"))
+	return err
+}
+
+func TestWrapBody(t *testing.T) {
+	// Test: Body is rewritten and its length taken after the rewrite
+	var buf bytes.Buffer
+	w := MakeWriter(&buf)
+	require.NoError(t, w.WrapBody(func(out io.Writer) io.WriteCloser { return &upperCaser{out: out} }))
+	w.Header().Set("Content-Length", "5")
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nHELLO", buf.String())
+
+	// Test: Later wrappers write through the earlier ones
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.WrapBody(func(out io.Writer) io.WriteCloser { return &upperCaser{out: out} }))
+	require.NoError(t, w.WrapBody(func(out io.Writer) io.WriteCloser { return suffixer{out} }))
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\nHELLO!", buf.String())
+	assert.Equal(t, 6, w.BytesWritten())
+
+	// Test: Flushed body is chunked even if a Content-Length was set
+	buf.Reset()
+	w = MakeWriter(&buf)
+	require.NoError(t, w.WrapBody(func(out io.Writer) io.WriteCloser { return suffixer{out} }))
+	w.Header().Set("Content-Length", "5")
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.NoError(t, w.Finish())
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n", buf.String())
+
+	// Test: Body can't be wrapped once written
+	w = MakeWriter(io.Discard)
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Error(t, w.WrapBody(func(out io.Writer) io.WriteCloser { return suffixer{out} }))
+}
@@ -0,0 +1,145 @@
+package response
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type StatusCode int
+
+// Status codes registered for HTTP, as defined in RFC 9110 unless noted.
+const (
+	StatusContinue           StatusCode = 100
+	StatusSwitchingProtocols StatusCode = 101
+	StatusEarlyHints         StatusCode = 103 // RFC 8297
+
+	StatusOK                   StatusCode = 200
+	StatusCreated              StatusCode = 201
+	StatusAccepted             StatusCode = 202
+	StatusNonAuthoritativeInfo StatusCode = 203
+	StatusNoContent            StatusCode = 204
+	StatusResetContent         StatusCode = 205
+	StatusPartialContent       StatusCode = 206
+
+	StatusMultipleChoices   StatusCode = 300
+	StatusMovedPermanently  StatusCode = 301
+	StatusFound             StatusCode = 302
+	StatusSeeOther          StatusCode = 303
+	StatusNotModified       StatusCode = 304
+	StatusUseProxy          StatusCode = 305
+	StatusTemporaryRedirect StatusCode = 307
+	StatusPermanentRedirect StatusCode = 308
+
+	StatusBadRequest                   StatusCode = 400
+	StatusUnauthorized                 StatusCode = 401
+	StatusPaymentRequired              StatusCode = 402
+	StatusForbidden                    StatusCode = 403
+	StatusNotFound                     StatusCode = 404
+	StatusMethodNotAllowed             StatusCode = 405
+	StatusNotAcceptable                StatusCode = 406
+	StatusProxyAuthRequired            StatusCode = 407
+	StatusRequestTimeout               StatusCode = 408
+	StatusConflict                     StatusCode = 409
+	StatusGone                         StatusCode = 410
+	StatusLengthRequired               StatusCode = 411
+	StatusPreconditionFailed           StatusCode = 412
+	StatusRequestEntityTooLarge        StatusCode = 413
+	StatusRequestURITooLong            StatusCode = 414
+	StatusUnsupportedMediaType         StatusCode = 415
+	StatusRequestedRangeNotSatisfiable StatusCode = 416
+	StatusExpectationFailed            StatusCode = 417
+	StatusMisdirectedRequest           StatusCode = 421
+	StatusUnprocessableEntity          StatusCode = 422
+	StatusUpgradeRequired              StatusCode = 426
+	StatusPreconditionRequired         StatusCode = 428 // RFC 6585
+	StatusTooManyRequests              StatusCode = 429 // RFC 6585
+	StatusRequestHeaderFieldsTooLarge  StatusCode = 431 // RFC 6585
+
+	StatusInternalServerError           StatusCode = 500
+	StatusNotImplemented                StatusCode = 501
+	StatusBadGateway                    StatusCode = 502
+	StatusServiceUnavailable            StatusCode = 503
+	StatusGatewayTimeout                StatusCode = 504
+	StatusHTTPVersionNotSupported       StatusCode = 505
+	StatusNetworkAuthenticationRequired StatusCode = 511 // RFC 6585
+)
+
+var statusText = map[StatusCode]string{
+	StatusContinue:           "Continue",
+	StatusSwitchingProtocols: "Switching Protocols",
+	StatusEarlyHints:         "Early Hints",
+
+	StatusOK:                   "OK",
+	StatusCreated:              "Created",
+	StatusAccepted:             "Accepted",
+	StatusNonAuthoritativeInfo: "Non-Authoritative Information",
+	StatusNoContent:            "No Content",
+	StatusResetContent:         "Reset Content",
+	StatusPartialContent:       "Partial Content",
+
+	StatusMultipleChoices:   "Multiple Choices",
+	StatusMovedPermanently:  "Moved Permanently",
+	StatusFound:             "Found",
+	StatusSeeOther:          "See Other",
+	StatusNotModified:       "Not Modified",
+	StatusUseProxy:          "Use Proxy",
+	StatusTemporaryRedirect: "Temporary Redirect",
+	StatusPermanentRedirect: "Permanent Redirect",
+
+	StatusBadRequest:                   "Bad Request",
+	StatusUnauthorized:                 "Unauthorized",
+	StatusPaymentRequired:              "Payment Required",
+	StatusForbidden:                    "Forbidden",
+	StatusNotFound:                     "Not Found",
+	StatusMethodNotAllowed:             "Method Not Allowed",
+	StatusNotAcceptable:                "Not Acceptable",
+	StatusProxyAuthRequired:            "Proxy Authentication Required",
+	StatusRequestTimeout:               "Request Timeout",
+	StatusConflict:                     "Conflict",
+	StatusGone:                         "Gone",
+	StatusLengthRequired:               "Length Required",
+	StatusPreconditionFailed:           "Precondition Failed",
+	StatusRequestEntityTooLarge:        "Content Too Large",
+	StatusRequestURITooLong:            "URI Too Long",
+	StatusUnsupportedMediaType:         "Unsupported Media Type",
+	StatusRequestedRangeNotSatisfiable: "Range Not Satisfiable",
+	StatusExpectationFailed:            "Expectation Failed",
+	StatusMisdirectedRequest:           "Misdirected Request",
+	StatusUnprocessableEntity:          "Unprocessable Content",
+	StatusUpgradeRequired:              "Upgrade Required",
+	StatusPreconditionRequired:         "Precondition Required",
+	StatusTooManyRequests:              "Too Many Requests",
+	StatusRequestHeaderFieldsTooLarge:  "Request Header Fields Too Large",
+
+	StatusInternalServerError:           "Internal Server Error",
+	StatusNotImplemented:                "Not Implemented",
+	StatusBadGateway:                    "Bad Gateway",
+	StatusServiceUnavailable:            "Service Unavailable",
+	StatusGatewayTimeout:                "Gateway Timeout",
+	StatusHTTPVersionNotSupported:       "HTTP Version Not Supported",
+	StatusNetworkAuthenticationRequired: "Network Authentication Required",
+}
+
+// StatusText returns the reason phrase for a status code, or an empty string
+// if the code isn't registered.
+func StatusText(statusCode StatusCode) string {
+	return statusText[statusCode]
+}
+
+// statusLine builds the status line for any three-digit code from 100 to 599.
+// Unregistered codes are sent with an empty reason phrase, which the grammar
+// allows.
+func statusLine(statusCode StatusCode) ([]byte, error) {
+	if statusCode < 100 || statusCode > 599 {
+		return nil, fmt.Errorf("invalid status code: %d", statusCode)
+	}
+
+	codeString := strconv.Itoa(int(statusCode))
+	return []byte("HTTP/1.1 " + codeString + " " + StatusText(statusCode) + "\r\n"), nil
+}
+
+// bodyForbidden reports whether responses with the status code never have a
+// body (RFC 9110 6.4.1).
+func bodyForbidden(statusCode StatusCode) bool {
+	return (statusCode >= 100 && statusCode < 200) || statusCode == StatusNoContent || statusCode == StatusNotModified
+}
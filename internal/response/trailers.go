@@ -0,0 +1,139 @@
+package response
+
+import (
+	"fmt"
+	"httpfromtcp/internal/headers"
+	"strings"
+)
+
+// forbiddenTrailers are fields a recipient needs before the body, for framing,
+// routing, authentication or processing the content, so they can't be sent as
+// trailers (RFC 9110 6.5.1).
+var forbiddenTrailers = map[string]bool{
+	"Authorization":       true,
+	"Cache-Control":       true,
+	"Connection":          true,
+	"Content-Encoding":    true,
+	"Content-Length":      true,
+	"Content-Range":       true,
+	"Content-Type":        true,
+	"Expect":              true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Max-Forwards":        true,
+	"Pragma":              true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Range":               true,
+	"Set-Cookie":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Www-Authenticate":    true,
+}
+
+// DeclareTrailers registers the names of the trailer fields the response will
+// send. They are listed in the Trailer header, and a buffered response is sent
+// chunked so the trailers can follow the body. It must be called before the
+// headers are written.
+func (w *Writer) DeclareTrailers(names ...string) error {
+	if w.writerState > writeHeaders {
+		return fmt.Errorf("cannot declare trailers after the headers are written")
+	}
+	for _, name := range names {
+		name = headers.CanonicalName(name)
+		if forbiddenTrailers[name] {
+			return fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+		}
+		if !w.isDeclared(name) {
+			w.trailers = append(w.trailers, name)
+		}
+	}
+	return nil
+}
+
+// Trailer returns the trailers Finish sends after a chunked body. Their names
+// must be declared with DeclareTrailers.
+func (w *Writer) Trailer() *headers.Headers {
+	if w.trailer == nil {
+		w.trailer = headers.NewHeaders()
+	}
+	return w.trailer
+}
+
+func (w *Writer) isDeclared(name string) bool {
+	for _, declared := range w.trailers {
+		if strings.EqualFold(declared, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// declareTrailerHeader adds the names listed in a Trailer header the handler
+// wrote itself, and returns the declared names it doesn't list yet. Like
+// DeclareTrailers, it fails for a name that can't be a trailer.
+func (w *Writer) declareTrailerHeader(h *headers.Headers) ([]string, error) {
+	var listed []string
+	for _, value := range h.Values("Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				name = headers.CanonicalName(name)
+				if forbiddenTrailers[name] {
+					return nil, fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+				}
+				listed = append(listed, name)
+			}
+		}
+	}
+
+	var missing []string
+	for _, name := range w.trailers {
+		found := false
+		for _, l := range listed {
+			if strings.EqualFold(l, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+
+	for _, name := range listed {
+		if !w.isDeclared(name) {
+			w.trailers = append(w.trailers, name)
+		}
+	}
+	return missing, nil
+}
+
+// checkTrailers fails unless every field in h may be sent as a trailer of this
+// response.
+func (w *Writer) checkTrailers(h *headers.Headers) error {
+	if !w.chunked {
+		return ErrTrailersNotChunked
+	}
+
+	var err error
+	h.Range(func(name, _ string) bool {
+		if forbiddenTrailers[name] {
+			err = fmt.Errorf("%w: %s", ErrForbiddenTrailer, name)
+		} else if !w.isDeclared(name) {
+			err = fmt.Errorf("%w: %s", ErrUndeclaredTrailer, name)
+		}
+		return err == nil
+	})
+	return err
+}
+
+// finishTrailers ends a chunked body that has had its last chunk written,
+// sending the trailers set with Trailer if there are any.
+func (w *Writer) finishTrailers() error {
+	if w.trailer != nil && w.trailer.Len() > 0 {
+		return w.WriteTrailers(w.trailer)
+	}
+	return w.WriteDone()
+}
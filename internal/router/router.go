@@ -0,0 +1,270 @@
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+)
+
+type segmentKind int
+
+// segment kinds are ordered from the most to the least specific
+const (
+	literal segmentKind = iota
+	parameter
+	wildcard
+)
+
+type segment struct {
+	kind segmentKind
+	// value is the text of a literal, or the name of a parameter or wildcard
+	value string
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []segment
+	handler  server.Handler
+}
+
+// Router dispatches requests to the handler of the route matching their method
+// and path. Requests for a path no route matches get a 404, and requests whose
+// path matches only routes for other methods get a 405 listing them in Allow.
+type Router struct {
+	routes []*route
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for requests with the given method, or any method
+// if it is empty, whose path matches pattern. A GET route also serves HEAD.
+//
+// A pattern is a path of segments separated by "/". A segment "{name}" matches
+// any single segment, and a final segment "{name...}" matches the rest of the
+// path, possibly empty. The matched text is available from the request's
+// PathValue. When several routes match, the one that is more specific at the
+// first segment where they differ wins: a literal before a parameter before a
+// wildcard. Between routes with the same pattern, one for the exact method wins
+// over GET serving HEAD, which wins over a route for any method.
+//
+// Handle panics if the pattern is invalid or conflicts with a route already
+// registered.
+func (r *Router) Handle(method, pattern string, handler server.Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(err)
+	}
+
+	rt := &route{method: method, pattern: pattern, segments: segments, handler: handler}
+	for _, existing := range r.routes {
+		if existing.method == method && sameShape(existing.segments, segments) {
+			panic(fmt.Sprintf("router: pattern %q conflicts with %q", pattern, existing.pattern))
+		}
+	}
+	r.routes = append(r.routes, rt)
+}
+
+// ServeRequest is a server.Handler that dispatches req to the matching route.
+// "OPTIONS *" is answered with every method the routes accept, and CONNECT
+// requests, which name no path, find no route.
+func (r *Router) ServeRequest(w *response.Writer, req *request.Request) {
+	switch req.RequestLine.TargetForm {
+	case request.AsteriskForm:
+		var allowed []string
+		for _, rt := range r.routes {
+			if rt.method != "" {
+				allowed = appendMethods(allowed, rt.method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(appendMethods(allowed, "OPTIONS"), ", "))
+		return
+	case request.AuthorityForm:
+		writeStatus(w, response.StatusNotFound)
+		return
+	}
+	parts := splitPath(req.URL.RawPath)
+
+	var best *route
+	var bestValues map[string]string
+	var allowed []string
+	for _, rt := range r.routes {
+		values, ok := rt.match(parts)
+		if !ok {
+			continue
+		}
+		if !rt.allows(req.RequestLine.Method) {
+			allowed = appendMethods(allowed, rt.method)
+			continue
+		}
+		if best == nil || moreSpecific(rt.segments, best.segments) ||
+			(sameShape(rt.segments, best.segments) && rt.methodRank(req.RequestLine.Method) < best.methodRank(req.RequestLine.Method)) {
+			best, bestValues = rt, values
+		}
+	}
+
+	if best == nil {
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+			writeStatus(w, response.StatusMethodNotAllowed)
+			return
+		}
+		writeStatus(w, response.StatusNotFound)
+		return
+	}
+
+	for name, value := range bestValues {
+		req.SetPathValue(name, value)
+	}
+	best.handler(w, req)
+}
+
+func writeStatus(w *response.Writer, statusCode response.StatusCode) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(response.StatusText(statusCode)))
+}
+
+func (rt *route) allows(method string) bool {
+	return rt.method == "" || rt.method == method || (rt.method == "GET" && method == "HEAD")
+}
+
+// methodRank orders routes with the same pattern that allow method, preferring
+// the one registered for exactly that method.
+func (rt *route) methodRank(method string) int {
+	switch rt.method {
+	case method:
+		return 0
+	case "":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// appendMethods adds what a route's method allows to the methods listed in an
+// Allow header, keeping them sorted and without duplicates.
+func appendMethods(allowed []string, method string) []string {
+	methods := []string{method}
+	if method == "GET" {
+		methods = append(methods, "HEAD")
+	}
+	for _, m := range methods {
+		if !slices.Contains(allowed, m) {
+			allowed = append(allowed, m)
+		}
+	}
+	slices.Sort(allowed)
+	return allowed
+}
+
+// splitPath splits a raw path into its decoded segments. Splitting before
+// decoding keeps an escaped "/" inside its segment.
+func splitPath(rawPath string) []string {
+	parts := strings.Split(strings.TrimPrefix(rawPath, "/"), "/")
+	for i, part := range parts {
+		// the request package has already checked the escapes are valid
+		parts[i], _ = request.Unescape(part)
+	}
+	return parts
+}
+
+// match reports whether a path split into parts matches the route, returning
+// the values of its parameters.
+func (rt *route) match(parts []string) (map[string]string, bool) {
+	values := make(map[string]string)
+	for i, seg := range rt.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+		if seg.kind == wildcard {
+			values[seg.value] = strings.Join(parts[i:], "/")
+			return values, true
+		}
+
+		switch seg.kind {
+		case literal:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case parameter:
+			if parts[i] == "" {
+				return nil, false
+			}
+			values[seg.value] = parts[i]
+		}
+	}
+
+	if len(parts) != len(rt.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// moreSpecific reports whether a is preferred over b when both match a path.
+func moreSpecific(a, b []segment) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].kind != b[i].kind {
+			return a[i].kind < b[i].kind
+		}
+	}
+	// patterns that match the same path differ before either one ends
+	return false
+}
+
+// sameShape reports whether two patterns match exactly the same paths.
+func sameShape(a, b []segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].kind != b[i].kind || (a[i].kind == literal && a[i].value != b[i].value) {
+			return false
+		}
+	}
+	return true
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("router: pattern %q must start with /", pattern)
+	}
+
+	parts := strings.Split(pattern[1:], "/")
+	segments := make([]segment, 0, len(parts))
+	names := make(map[string]bool)
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("router: pattern %q has an invalid segment %q", pattern, part)
+			}
+			segments = append(segments, segment{kind: literal, value: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		kind := parameter
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("router: wildcard %q must be the last segment of %q", part, pattern)
+			}
+			name = strings.TrimSuffix(name, "...")
+			kind = wildcard
+		}
+		if name == "" || strings.ContainsAny(name, "{}.") {
+			return nil, fmt.Errorf("router: pattern %q has an invalid parameter %q", pattern, part)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("router: pattern %q uses the parameter %q twice", pattern, name)
+		}
+		names[name] = true
+		segments = append(segments, segment{kind: kind, value: name})
+	}
+	return segments, nil
+}
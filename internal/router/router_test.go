@@ -0,0 +1,134 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+	"httpfromtcp/internal/server"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouting(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/users", named("list users"))
+	r.Handle("POST", "/users", named("create user"))
+	r.Handle("GET", "/users/{id}", named("get user {id}"))
+	r.Handle("GET", "/users/me", named("get me"))
+	r.Handle("DELETE", "/users/{id}", named("delete user {id}"))
+	r.Handle("GET", "/users/{id}/posts/{post}", named("get post {post} of {id}"))
+	r.Handle("GET", "/files/{path...}", named("get file {path}"))
+	r.Handle("", "/any", named("any method"))
+	r.Handle("PUT", "/any", named("put"))
+
+	// Test: Literal route
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nlist users", serve(t, r, "GET", "/users"))
+
+	// Test: Method picks between routes with the same pattern
+	assert.Contains(t, serve(t, r, "POST", "/users"), "create user")
+
+	// Test: Parameters are set on the request
+	assert.Contains(t, serve(t, r, "GET", "/users/42"), "get user 42")
+	assert.Contains(t, serve(t, r, "DELETE", "/users/42"), "delete user 42")
+	assert.Contains(t, serve(t, r, "GET", "/users/42/posts/7"), "get post 7 of 42")
+
+	// Test: Literal segment wins over a parameter regardless of order
+	assert.Contains(t, serve(t, r, "GET", "/users/me"), "get me")
+
+	// Test: Route for another method doesn't shadow a less specific match
+	assert.Contains(t, serve(t, r, "DELETE", "/users/me"), "delete user me")
+
+	// Test: Query string is ignored for matching
+	assert.Contains(t, serve(t, r, "GET", "/users/42?full=true"), "get user 42")
+
+	// Test: Segments are matched and captured decoded
+	assert.Contains(t, serve(t, r, "GET", "/user%73/j%20doe"), "get user j doe")
+	assert.Contains(t, serve(t, r, "GET", "/users/a%2Fb"), "get user a/b")
+
+	// Test: Wildcard matches the rest of the path, including nothing
+	assert.Contains(t, serve(t, r, "GET", "/files/a/b/c.txt"), "get file a/b/c.txt")
+	assert.True(t, strings.HasSuffix(serve(t, r, "GET", "/files/"), "\r\n\r\nget file "))
+
+	// Test: GET route serves HEAD
+	assert.Contains(t, serve(t, r, "HEAD", "/users"), "HTTP/1.1 200 OK")
+
+	// Test: Route for the exact method wins over one for any method
+	assert.Contains(t, serve(t, r, "PUT", "/any"), "put")
+	assert.Contains(t, serve(t, r, "PATCH", "/any"), "any method")
+
+	// Test: Unknown paths are a 404
+	assert.Contains(t, serve(t, r, "GET", "/nothing"), "HTTP/1.1 404 Not Found")
+	assert.Contains(t, serve(t, r, "GET", "/users/"), "HTTP/1.1 404 Not Found")
+	assert.Contains(t, serve(t, r, "GET", "/files"), "HTTP/1.1 404 Not Found")
+	assert.Contains(t, serve(t, r, "GET", "/users/1/2"), "HTTP/1.1 404 Not Found")
+
+	// Test: Known paths with the wrong method are a 405 with Allow
+	resp := serve(t, r, "PATCH", "/users/42")
+	assert.Contains(t, resp, "HTTP/1.1 405 Method Not Allowed")
+	assert.Contains(t, resp, "Allow: DELETE, GET, HEAD\r\n")
+	resp = serve(t, r, "DELETE", "/users")
+	assert.Contains(t, resp, "Allow: GET, HEAD, POST\r\n")
+}
+
+func TestTargetForms(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/users", named("list users"))
+	r.Handle("POST", "/users", named("create user"))
+	r.Handle("", "/any", named("any method"))
+
+	// Test: OPTIONS * lists the methods of every route
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nAllow: GET, HEAD, OPTIONS, POST\r\nContent-Length: 0\r\n\r\n", serve(t, r, "OPTIONS", "*"))
+
+	// Test: Absolute-form targets are routed by their path
+	assert.Contains(t, serve(t, r, "GET", "http://example.com/users?page=2"), "list users")
+
+	// Test: CONNECT has no path to route
+	assert.Contains(t, serve(t, r, "CONNECT", "example.com:443"), "HTTP/1.1 404 Not Found")
+}
+
+func TestInvalidPatterns(t *testing.T) {
+	r := NewRouter()
+	r.Handle("GET", "/users/{id}", named("user"))
+
+	// Test: Patterns must be valid
+	assert.Panics(t, func() { r.Handle("GET", "users", named("")) })
+	assert.Panics(t, func() { r.Handle("GET", "/{}", named("")) })
+	assert.Panics(t, func() { r.Handle("GET", "/a{b}", named("")) })
+	assert.Panics(t, func() { r.Handle("GET", "/{rest...}/more", named("")) })
+	assert.Panics(t, func() { r.Handle("GET", "/{id}/{id}", named("")) })
+
+	// Test: Routes matching the same paths for the same method conflict
+	assert.Panics(t, func() { r.Handle("GET", "/users/{name}", named("")) })
+	assert.NotPanics(t, func() { r.Handle("POST", "/users/{name}", named("")) })
+}
+
+// named returns a handler writing its name, with "{param}" replaced by the
+// value of each path parameter.
+func named(name string) server.Handler {
+	return func(w *response.Writer, req *request.Request) {
+		body := name
+		for _, param := range []string{"id", "post", "path"} {
+			body = strings.ReplaceAll(body, "{"+param+"}", req.PathValue(param))
+		}
+		w.Write([]byte(body))
+	}
+}
+
+func serve(t *testing.T, r *Router, method, target string) string {
+	t.Helper()
+	req, err := request.RequestFromReader(strings.NewReader(method + " " + target + " HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w := response.MakeWriter(&buf)
+	if method == "HEAD" {
+		w.DiscardBody()
+	}
+	r.ServeRequest(w, req)
+	require.NoError(t, w.Finish())
+	return buf.String()
+}
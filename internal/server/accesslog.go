@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpfromtcp/internal/response"
+)
+
+type AccessLogFormat int
+
+const (
+	// CommonLogFormat is the NCSA Common Log Format:
+	// host ident user [time] "request" status bytes
+	CommonLogFormat AccessLogFormat = iota
+	// CombinedLogFormat is CommonLogFormat followed by the quoted Referer and
+	// User-Agent
+	CombinedLogFormat
+	// JSONLogFormat logs every field of the entry, duration included, as a
+	// JSON object through log/slog
+	JSONLogFormat
+)
+
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogEntry describes one request the server answered. Method, Target
+// and Version are empty for a request whose line couldn't be parsed.
+type AccessLogEntry struct {
+	RemoteAddr string
+	// Time is when the request started to arrive
+	Time    time.Time
+	Method  string
+	Target  string
+	Version string
+	Status  response.StatusCode
+	// Bytes is the size of the response body sent
+	Bytes     int
+	Duration  time.Duration
+	Referer   string
+	UserAgent string
+}
+
+// AccessLogger writes one line per request served, safe for use by every
+// connection at once.
+type AccessLogger struct {
+	format AccessLogFormat
+	mu     sync.Mutex
+	out    io.Writer
+	logger *slog.Logger
+}
+
+func NewAccessLogger(out io.Writer, format AccessLogFormat) *AccessLogger {
+	l := &AccessLogger{format: format, out: out}
+	if format == JSONLogFormat {
+		l.logger = slog.New(slog.NewJSONHandler(out, nil))
+	}
+	return l
+}
+
+func (l *AccessLogger) Log(entry AccessLogEntry) {
+	if l.format == JSONLogFormat {
+		record := slog.NewRecord(entry.Time, slog.LevelInfo, "request", 0)
+		record.AddAttrs(
+			slog.String("remote_addr", entry.RemoteAddr),
+			slog.String("method", entry.Method),
+			slog.String("target", entry.Target),
+			slog.String("version", entry.Version),
+			slog.Int("status", int(entry.Status)),
+			slog.Int("bytes", entry.Bytes),
+			slog.Duration("duration", entry.Duration),
+			slog.String("referer", entry.Referer),
+			slog.String("user_agent", entry.UserAgent),
+		)
+		l.logger.Handler().Handle(context.Background(), record)
+		return
+	}
+
+	host, _, err := net.SplitHostPort(entry.RemoteAddr)
+	if err != nil {
+		host = entry.RemoteAddr
+	}
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.Itoa(entry.Bytes)
+	}
+
+	requestLine := "-"
+	if entry.Method != "" {
+		requestLine = escape(entry.Method + " " + entry.Target + " " + entry.Version)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s\" %d %s",
+		orDash(host), entry.Time.Format(commonLogTime), requestLine, entry.Status, bytes)
+	if l.format == CombinedLogFormat {
+		line += fmt.Sprintf(" \"%s\" \"%s\"", escape(orDash(entry.Referer)), escape(orDash(entry.UserAgent)))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line+"\n")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// escape keeps a quoted log field from being ended early by the client.
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
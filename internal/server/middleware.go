@@ -0,0 +1,16 @@
+package server
+
+// Middleware wraps a Handler with behaviour that runs around it, such as
+// logging, authentication or compression. It can inspect what the inner handler
+// did through the response.Writer's Status and BytesWritten once the handler
+// returns, and transform the body it writes with WrapBody.
+type Middleware func(Handler) Handler
+
+// Chain wraps handler with each middleware in turn, so the first one listed is
+// the outermost and sees the request first.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
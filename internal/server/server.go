@@ -1,51 +1,232 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal/request"
 	"httpfromtcp/internal/response"
 	"io"
+	"log"
 	"net"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConnections           = 256
+	defaultMaxRequestsPerConnection = 100
+	defaultReadHeaderTimeout        = 10 * time.Second
+	defaultIdleTimeout              = 2 * time.Minute
+
+	// lingerTimeout and maxLingerBytes bound how long and how much unread
+	// input is discarded before closing a connection after an error
+	lingerTimeout  = 500 * time.Millisecond
+	maxLingerBytes = 256 << 10
+)
+
+type Options struct {
+	// MaxConnections caps how many connections are served at once. When the cap
+	// is reached the server stops accepting until a connection is closed, so new
+	// clients wait in the listen backlog. Zero means defaultMaxConnections.
+	MaxConnections int
+	// MaxRequestsPerConnection is how many requests are served on one
+	// persistent connection before the server closes it. Zero means
+	// defaultMaxRequestsPerConnection.
+	MaxRequestsPerConnection int
+	// ReadHeaderTimeout bounds reading the request line and headers. Zero means
+	// defaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading a whole request, body included. Zero means no
+	// limit beyond ReadHeaderTimeout.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds writing a response, from the end of reading the
+	// request. Zero means no limit.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a persistent connection waits for the next
+	// request. Zero means defaultIdleTimeout.
+	IdleTimeout time.Duration
+	// Limits bounds the size of the requests the server accepts.
+	Limits request.Limits
+	// AccessLog, if set, logs every request the server answers.
+	AccessLog *AccessLogger
+	// OnPanic is called with the value and stack trace of a panic recovered
+	// from a handler, after it is logged, to report it elsewhere.
+	OnPanic func(recovered any, stack []byte)
+}
+
+type connState int
+
+const (
+	// connNew connections are accepted but haven't sent their first request.
+	// Shutdown leaves them to send it, bounded by ReadHeaderTimeout, since the
+	// client may have written it before it saw the listener close.
+	connNew connState = iota
+	// connIdle connections are waiting for their next request and can be
+	// closed by Shutdown without cutting anything off
+	connIdle
+	connActive
 )
 
 type Server struct {
-	open     bool
 	listener net.Listener
 	handler  Handler
+	options  Options
+	slots    chan struct{}
+
+	mu      sync.Mutex
+	closing bool
+	conns   map[net.Conn]connState
+	active  sync.WaitGroup
 }
 
 func Serve(port int, handlerFunc Handler) (*Server, error) {
+	return ServeWithOptions(port, handlerFunc, Options{})
+}
+
+func ServeWithOptions(port int, handlerFunc Handler, options Options) (*Server, error) {
+	if options.MaxConnections <= 0 {
+		options.MaxConnections = defaultMaxConnections
+	}
+	if options.MaxRequestsPerConnection <= 0 {
+		options.MaxRequestsPerConnection = defaultMaxRequestsPerConnection
+	}
+	if options.ReadHeaderTimeout <= 0 {
+		options.ReadHeaderTimeout = defaultReadHeaderTimeout
+	}
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = defaultIdleTimeout
+	}
+
 	portString := ":" + strconv.Itoa(port)
 	listener, err := net.Listen("tcp", portString)
 	if err != nil {
 		return nil, err
 	}
 
-	server := Server{
-		open:     true,
+	server := &Server{
 		listener: listener,
 		handler:  handlerFunc,
+		options:  options,
+		slots:    make(chan struct{}, options.MaxConnections),
+		conns:    make(map[net.Conn]connState),
 	}
 
 	go server.listen()
-	return &server, nil
+	return server, nil
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
 }
 
+// Close stops the server immediately, closing the listener and every open
+// connection including those with requests in flight.
 func (s *Server) Close() error {
-	if !s.open {
+	err := s.closeListener()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for active
+// requests to finish. Connections are closed as soon as their current response
+// is written. A connection accepted but yet to send its first request gets
+// until ReadHeaderTimeout to send it, and the request is answered. If ctx expires first, Shutdown returns the context's error and
+// leaves the remaining connections to finish or to be cut off with Close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.closeListener()
+
+	s.mu.Lock()
+	for conn, state := range s.conns {
+		if state == connIdle {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) closeListener() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
 		return nil
 	}
 
-	s.open = false
+	s.closing = true
 	return s.listener.Close()
 }
 
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// trackConn registers a new connection, returning false if the server is
+// already closing and the connection should be dropped.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+
+	s.conns[conn] = connNew
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.Close()
+	delete(s.conns, conn)
+	s.active.Done()
+}
+
+// setConnState moves a connection between idle and active. It returns false
+// once the server is closing, in which case the connection should be closed
+// instead of taking another request, unless it is a new connection's first.
+func (s *Server) setConnState(conn net.Conn, state connState) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing && s.conns[conn] != connNew {
+		return false
+	}
+
+	s.conns[conn] = state
+	return true
+}
+
 func (s *Server) listen() {
-	for s.open {
+	for !s.isClosing() {
+		// wait for a free slot before accepting, this is our back-pressure
+		s.slots <- struct{}{}
+
 		conn, err := s.listener.Accept()
 		if err != nil {
-			if !s.open {
+			<-s.slots
+			if s.isClosing() {
 				// server is not open, so we return
 				return
 			}
@@ -53,20 +234,133 @@ func (s *Server) listen() {
 			continue
 		}
 
-		s.handle(conn)
-		conn.Close()
+		if !s.trackConn(conn) {
+			<-s.slots
+			conn.Close()
+			return
+		}
+
+		go func() {
+			defer func() { <-s.slots }()
+			defer s.untrackConn(conn)
+			s.handle(conn)
+		}()
 	}
 }
 
 func (s *Server) handle(conn net.Conn) {
-	req, err := request.RequestFromReader(conn)
-	if err != nil {
-		writeError(conn, &HandlerError{StatusCode: 500, Message: fmt.Sprintf("Error: %v", err)})
-	}
+	// one reader per connection keeps pipelined requests, which are then
+	// answered one at a time in the order they arrived
+	reader := request.NewReaderWithLimits(conn, s.options.Limits)
+	for served := 1; ; served++ {
+		start := time.Now()
+		waitDeadline := s.headerDeadline(start)
+		if served > 1 {
+			waitDeadline = deadline(start, s.options.IdleTimeout)
+		}
 
-	writer := response.MakeWriter(conn)
+		// a connection that sends nothing before the deadline, or that is idle
+		// when the server shuts down, is closed without a response
+		conn.SetReadDeadline(waitDeadline)
+		if err := reader.WaitForData(); err != nil {
+			return
+		}
+		if !s.setConnState(conn, connActive) {
+			return
+		}
 
-	s.handler(writer, req)
+		if served > 1 {
+			// the header timeout starts once the next request begins to arrive
+			start = time.Now()
+		}
+		headerDeadline := s.headerDeadline(start)
+		readDeadline := deadline(start, s.options.ReadTimeout)
+
+		conn.SetReadDeadline(headerDeadline)
+		req, err := reader.ReadRequest()
+		if err == io.EOF {
+			// client closed the connection between requests
+			return
+		}
+		if err != nil {
+			statusCode, message := errorStatus(err), fmt.Sprintf("Error: %v", err)
+			conn.SetWriteDeadline(deadline(time.Now(), s.options.WriteTimeout))
+			writeError(conn, &HandlerError{StatusCode: statusCode, Message: message})
+
+			failed := reader.LastRequest()
+			failed.RemoteAddr = conn.RemoteAddr().String()
+			s.logAccess(failed, start, statusCode, len(message))
+			lingerClose(conn)
+			return
+		}
+
+		// the handler reads the body itself, within what is left of the read timeout
+		conn.SetReadDeadline(readDeadline)
+		conn.SetWriteDeadline(deadline(time.Now(), s.options.WriteTimeout))
+
+		writer := response.MakeWriter(conn)
+		if req.RequestLine.Method == "HEAD" {
+			// HEAD is answered like GET, minus the body
+			writer.DiscardBody()
+		}
+		if req.RequestLine.HttpVersion == "1.0" {
+			writer.UseHTTP10()
+		}
+		if served >= s.options.MaxRequestsPerConnection || !req.KeepAlive() || s.isClosing() {
+			writer.CloseConnection()
+		}
+
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.OnContinue(func() error {
+			if writer.StatusLineWritten() {
+				// the client goes ahead once it has the final response
+				return nil
+			}
+			return writer.WriteInformational(response.StatusContinue, nil)
+		})
+		if !s.runHandler(conn, writer, req) {
+			s.abort(conn, writer, req, start, response.StatusInternalServerError, response.StatusText(response.StatusInternalServerError))
+			return
+		}
+
+		// discard any body the handler left unread so the next request can be
+		// read. A body the client was never asked for, or too much of one to
+		// drain, is left on the connection, which then can't be reused.
+		bodyLeft := req.ContinuePending()
+		if !bodyLeft {
+			bodyErr := req.Body.Close()
+			if errors.Is(bodyErr, request.ErrBodyNotDrained) {
+				bodyLeft = true
+			} else if bodyErr != nil {
+				s.abort(conn, writer, req, start, errorStatus(bodyErr), fmt.Sprintf("Error: %v", bodyErr))
+				return
+			}
+		}
+		if bodyLeft {
+			writer.CloseConnection()
+		}
+
+		// send whatever the handler left buffered or unfinished
+		err = writer.Finish()
+		if err != nil && !writer.StatusLineWritten() {
+			s.abort(conn, writer, req, start, response.StatusInternalServerError, response.StatusText(response.StatusInternalServerError))
+			return
+		}
+		s.logAccess(req, start, writer.Status(), writer.BytesWritten())
+		if err != nil {
+			return
+		}
+		if bodyLeft {
+			// let the client read the response before the rest of its body
+			// resets the connection
+			lingerClose(conn)
+			return
+		}
+
+		if writer.ShouldClose() || !s.setConnState(conn, connIdle) {
+			return
+		}
+	}
 
 	/*
 		if err := response.WriteStatusLine(conn, 200); err != nil {
@@ -92,6 +386,130 @@ func (s *Server) handle(conn net.Conn) {
 	*/
 }
 
+// runHandler calls the handler, recovering from a panic so it only takes down
+// this connection. It returns false if the handler panicked.
+func (s *Server) runHandler(conn net.Conn, writer *response.Writer, req *request.Request) (ok bool) {
+	defer func() {
+		recovered := recover()
+		if recovered == nil {
+			return
+		}
+
+		stack := debug.Stack()
+		log.Printf("server: panic serving %s %s for %v: %v\n%s", req.RequestLine.Method, req.RequestLine.RequestTarget, conn.RemoteAddr(), recovered, stack)
+		if s.options.OnPanic != nil {
+			s.options.OnPanic(recovered, stack)
+		}
+		ok = false
+	}()
+
+	s.handler(writer, req)
+	return true
+}
+
+// abort ends a request that failed while it was being handled. If the response
+// hasn't been started it is answered with an error, otherwise what was sent is
+// all the client gets. Either way the connection must then be closed.
+func (s *Server) abort(conn net.Conn, writer *response.Writer, req *request.Request, start time.Time, statusCode response.StatusCode, message string) {
+	if writer.StatusLineWritten() {
+		s.logAccess(req, start, writer.Status(), writer.BytesWritten())
+		return
+	}
+
+	writeError(conn, &HandlerError{StatusCode: statusCode, Message: message})
+	s.logAccess(req, start, statusCode, len(message))
+	lingerClose(conn)
+}
+
+func (s *Server) logAccess(req *request.Request, start time.Time, statusCode response.StatusCode, bytes int) {
+	if s.options.AccessLog == nil {
+		return
+	}
+
+	if req.RequestLine.Method == "HEAD" {
+		// the body was counted but never sent
+		bytes = 0
+	}
+	version := ""
+	if req.RequestLine.HttpVersion != "" {
+		// empty for a request whose line couldn't be parsed
+		version = "HTTP/" + req.RequestLine.HttpVersion
+	}
+	referer, _ := req.Headers.Get("Referer")
+	userAgent, _ := req.Headers.Get("User-Agent")
+	s.options.AccessLog.Log(AccessLogEntry{
+		RemoteAddr: req.RemoteAddr,
+		Time:       start,
+		Method:     req.RequestLine.Method,
+		Target:     req.RequestLine.RequestTarget,
+		Version:    version,
+		Status:     statusCode,
+		Bytes:      bytes,
+		Duration:   time.Since(start),
+		Referer:    referer,
+		UserAgent:  userAgent,
+	})
+}
+
+// lingerClose stops writing and discards what the client is still sending for
+// a moment, so closing with unread input doesn't reset the connection and
+// destroy the error response before the client has read it.
+func lingerClose(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+	io.CopyN(io.Discard, conn, maxLingerBytes)
+}
+
+// headerDeadline is when the request line and headers of a request started at
+// start must have been read, the earlier of the header and read timeouts.
+func (s *Server) headerDeadline(start time.Time) time.Time {
+	headerDeadline := deadline(start, s.options.ReadHeaderTimeout)
+	readDeadline := deadline(start, s.options.ReadTimeout)
+	if !readDeadline.IsZero() && readDeadline.Before(headerDeadline) {
+		return readDeadline
+	}
+	return headerDeadline
+}
+
+// deadline returns the time timeout after start, or the zero time (no
+// deadline) when timeout is not set.
+func deadline(start time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return start.Add(timeout)
+}
+
+// errorStatus picks the status code to answer a request that failed to be
+// read. Anything not singled out is the client's fault, so it is a 400.
+func errorStatus(err error) response.StatusCode {
+	switch {
+	case isTimeout(err):
+		return response.StatusRequestTimeout
+	case errors.Is(err, request.ErrRequestLineTooLong):
+		return response.StatusRequestURITooLong
+	case errors.Is(err, request.ErrHeaderTooLarge):
+		return response.StatusRequestHeaderFieldsTooLarge
+	case errors.Is(err, request.ErrBodyTooLarge):
+		return response.StatusRequestEntityTooLarge
+	case errors.Is(err, request.ErrUnsupportedTransferEncoding):
+		return response.StatusNotImplemented
+	case errors.Is(err, request.ErrUnsupportedVersion):
+		return response.StatusHTTPVersionNotSupported
+	case errors.Is(err, request.ErrUnsupportedExpectation):
+		return response.StatusExpectationFailed
+	default:
+		return response.StatusBadRequest
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 type Handler func(w *response.Writer, request *request.Request)
 
 type HandlerError struct {
@@ -105,6 +523,7 @@ func writeError(w io.Writer, h *HandlerError) {
 	}
 
 	headers := response.GetDefaultHeaders(len(h.Message))
+	headers.Set("connection", "close")
 	if err := response.WriteHeaders(w, headers); err != nil {
 		fmt.Printf("Error writing headers: %v\n", err)
 	}
@@ -0,0 +1,1086 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentConnections(t *testing.T) {
+	// Test: Two slow clients are served in parallel
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	s, err := ServeWithOptions(0, blockingHandler(entered, release), Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	results := make(chan string, 2)
+	go func() { results <- sendRequest(t, s.Addr().String()) }()
+	go func() { results <- sendRequest(t, s.Addr().String()) }()
+
+	waitFor(t, entered)
+	waitFor(t, entered)
+	close(release)
+	assert.Contains(t, <-results, "HTTP/1.1 200 OK")
+	assert.Contains(t, <-results, "HTTP/1.1 200 OK")
+
+	// Test: Connection cap holds back extra clients until a slot is free
+	entered = make(chan struct{}, 2)
+	release = make(chan struct{})
+	s2, err := ServeWithOptions(0, blockingHandler(entered, release), Options{MaxConnections: 1})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	go func() { results <- sendRequest(t, s2.Addr().String()) }()
+	waitFor(t, entered)
+	go func() { results <- sendRequest(t, s2.Addr().String()) }()
+
+	select {
+	case <-entered:
+		t.Fatal("second connection was handled while the cap was reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, entered)
+	assert.Contains(t, <-results, "HTTP/1.1 200 OK")
+	assert.Contains(t, <-results, "HTTP/1.1 200 OK")
+}
+
+func TestKeepAlive(t *testing.T) {
+	s, err := ServeWithOptions(0, okHandler, Options{MaxRequestsPerConnection: 3})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Several requests are served on one connection
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		require.NoError(t, err)
+		resp := readResponse(t, reader)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "", resp.Header.Get("Connection"))
+		assert.False(t, resp.Close)
+	}
+
+	// Test: Server closes once the max requests per connection is reached
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, reader)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+
+	// Test: Client asks to close the connection
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader = bufio.NewReader(conn2)
+
+	_, err = conn2.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: keep-alive, Close\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+
+	// Test: Handler asks to close the connection
+	s2, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		h := response.GetDefaultHeaders(0)
+		h.Set("Connection", "close")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(h)
+		w.WriteBody(nil)
+	}, Options{})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	conn3, err := net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer conn3.Close()
+	reader = bufio.NewReader(conn3)
+
+	_, err = conn3.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+}
+
+func TestPipelining(t *testing.T) {
+	// Test: Pipelined requests are answered in order
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		// make the first request the slowest to catch any reordering
+		if req.RequestLine.RequestTarget == "/1" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		body := []byte(req.RequestLine.RequestTarget)
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET /1 HTTP/1.1\r\nHost: localhost\r\n\r\n" +
+		"POST /2 HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nbody" +
+		"GET /3 HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	require.NoError(t, err)
+
+	for _, target := range []string{"/1", "/2", "/3"} {
+		resp, err := http.ReadResponse(reader, nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, target, string(body))
+	}
+	assertClosed(t, reader)
+}
+
+func TestTimeouts(t *testing.T) {
+	s, err := ServeWithOptions(0, echoHandler, Options{
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		ReadTimeout:       300 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Client stops sending in the middle of the headers
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, reader)
+	assert.Equal(t, 408, resp.StatusCode)
+	assertClosed(t, reader)
+
+	// Test: Client stops sending in the middle of the body
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader = bufio.NewReader(conn2)
+
+	_, err = conn2.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nab"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.Equal(t, 408, resp.StatusCode)
+	assertClosed(t, reader)
+
+	// Test: A slow body is allowed past the header timeout, within the read timeout
+	conn3, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn3.Close()
+	reader = bufio.NewReader(conn3)
+
+	_, err = conn3.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 4\r\n\r\nab"))
+	require.NoError(t, err)
+	time.Sleep(150 * time.Millisecond)
+	_, err = conn3.Write([]byte("cd"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(body))
+
+	// Test: Idle connection is closed without a response
+	time.Sleep(200 * time.Millisecond)
+	assertClosed(t, reader)
+
+	// Test: Handler that outlives the write timeout gets its connection cut
+	s2, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		time.Sleep(150 * time.Millisecond)
+		okHandler(w, req)
+	}, Options{WriteTimeout: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	conn4, err := net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer conn4.Close()
+	reader = bufio.NewReader(conn4)
+
+	_, err = conn4.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	assertClosed(t, reader)
+}
+
+func TestShutdown(t *testing.T) {
+	// Test: Shutdown waits for active requests and closes idle connections
+	entered := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blocking := blockingHandler(entered, release)
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/slow" {
+			blocking(w, req)
+			return
+		}
+		okHandler(w, req)
+	}, Options{})
+	require.NoError(t, err)
+
+	// connections are accepted in order, so once the later ones are answered
+	// this one is known to the server without having sent anything
+	fresh, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer fresh.Close()
+	freshReader := bufio.NewReader(fresh)
+
+	active, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer active.Close()
+	activeReader := bufio.NewReader(active)
+	_, err = active.Write([]byte("GET /slow HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	waitFor(t, entered)
+
+	idle, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	_, err = idle.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, idleReader)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	assertClosed(t, idleReader)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the active request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = net.Dial("tcp", s.Addr().String())
+	assert.Error(t, err)
+
+	// Test: A connection yet to send its first request is still answered
+	_, err = fresh.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, freshReader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assertClosed(t, freshReader)
+
+	close(release)
+	resp = readResponse(t, activeReader)
+	assert.Equal(t, 200, resp.StatusCode)
+	assertClosed(t, activeReader)
+
+	select {
+	case err = <-shutdown:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("shutdown did not return after connections drained")
+	}
+
+	// Test: A new connection that sends nothing is closed at ReadHeaderTimeout
+	s1, err := ServeWithOptions(0, okHandler, Options{ReadHeaderTimeout: 100 * time.Millisecond})
+	require.NoError(t, err)
+	defer s1.Close()
+
+	silent, err := net.Dial("tcp", s1.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+	require.Contains(t, sendRequest(t, s1.Addr().String()), "200 OK")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, s1.Shutdown(ctx))
+	assertClosed(t, bufio.NewReader(silent))
+
+	// Test: Shutdown gives up when the context expires
+	entered = make(chan struct{}, 1)
+	release = make(chan struct{})
+	s2, err := ServeWithOptions(0, blockingHandler(entered, release), Options{})
+	require.NoError(t, err)
+	defer s2.Close()
+	defer close(release)
+
+	stuck, err := net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer stuck.Close()
+	_, err = stuck.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	waitFor(t, entered)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s2.Shutdown(ctx))
+}
+
+func TestParseErrors(t *testing.T) {
+	s, err := ServeWithOptions(0, okHandler, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"malformed request line", "GET /\r\n\r\n", 400},
+		{"invalid method", "get / HTTP/1.1\r\nHost: localhost\r\n\r\n", 400},
+		{"invalid target", "GET /a%zz HTTP/1.1\r\nHost: localhost\r\n\r\n", 400},
+		{"invalid header name", "GET / HTTP/1.1\r\nHost: localhost\r\nH@st: localhost\r\n\r\n", 400},
+		{"invalid content length", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: abc\r\n\r\n", 400},
+		{"conflicting framing", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n", 400},
+		{"unsupported transfer encoding", "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"unsupported version", "GET / HTTP/1.2\r\n\r\n", 505},
+		{"newer major version", "GET / HTTP/2.0\r\n\r\n", 505},
+		{"malformed version", "GET / HTTP/x\r\n\r\n", 400},
+		{"unsupported expectation", "POST / HTTP/1.1\r\nHost: localhost\r\nExpect: nothing\r\n\r\n", 417},
+	} {
+		// Test: Parse error gets the matching status
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		_, err = conn.Write([]byte(tc.raw))
+		require.NoError(t, err)
+		resp := readResponse(t, reader)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+		assertClosed(t, reader)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	s, err := ServeWithOptions(0, echoHandler, Options{Limits: request.Limits{
+		MaxRequestLineLength: 64,
+		MaxHeaderCount:       2,
+		MaxBodySize:          8,
+	}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		name   string
+		raw    string
+		status int
+	}{
+		{"request line too long", "GET /" + strings.Repeat("a", 100) + " HTTP/1.1\r\nHost: localhost\r\n\r\n", 414},
+		{"too many headers", "GET / HTTP/1.1\r\nHost: localhost\r\nA: 1\r\nB: 2\r\n\r\n", 431},
+		{"content length too large", "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 9\r\n\r\n123456789", 413},
+		{"chunked body too large", "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n9\r\n123456789\r\n0\r\n\r\n", 413},
+	} {
+		// Test: Request over a limit gets the matching status
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		_, err = conn.Write([]byte(tc.raw))
+		require.NoError(t, err)
+		resp := readResponse(t, reader)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.name)
+	}
+}
+
+func TestUnreadBody(t *testing.T) {
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		w.WriteHeader(response.StatusRequestEntityTooLarge)
+		w.Write([]byte("nope"))
+	}, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Small unread body is drained and the connection reused
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello"))
+		require.NoError(t, err)
+		resp := readResponse(t, reader)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		assert.False(t, resp.Close)
+	}
+
+	// Test: Handler's response is sent even if the body is too large to drain
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader = bufio.NewReader(conn2)
+
+	size := 1 << 20
+	go func() {
+		// the server stops reading part way, so this may fail
+		conn2.Write([]byte(fmt.Sprintf("POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: %d\r\n\r\n", size)))
+		conn2.Write(bytes.Repeat([]byte("a"), size))
+	}()
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Equal(t, "nope", string(body))
+	assert.True(t, resp.Close)
+}
+
+func TestResponseFraming(t *testing.T) {
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		switch req.RequestLine.RequestTarget {
+		case "/large":
+			w.Write([]byte(strings.Repeat("a", 10000)))
+		case "/short":
+			w.Header().Set("Content-Length", "10")
+			w.Flush()
+			w.Write([]byte("small"))
+		default:
+			w.Write([]byte("small"))
+		}
+	}, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: Buffered body is sent with a Content-Length
+	_, err = conn.Write([]byte("GET /small HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	assert.Equal(t, "small", string(body))
+
+	// Test: Large body is chunked and the connection stays usable
+	_, err = conn.Write([]byte("GET /large HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+	assert.Equal(t, 10000, len(body))
+
+	_, err = conn.Write([]byte("GET /small HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Test: Body shorter than its Content-Length ends the connection
+	_, err = conn.Write([]byte("GET /short HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, "small", string(body))
+}
+
+func TestHead(t *testing.T) {
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("hello"))
+	}, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: HEAD gets the headers of the GET response without its body
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(5), resp.ContentLength)
+	resp.Body.Close()
+
+	// Test: The next response on the connection isn't corrupted by a stray body
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestHTTP10(t *testing.T) {
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("a", 10000)))
+			return
+		}
+		w.Write([]byte("small"))
+	}, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: HTTP/1.0 connections close after one response by default
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET /small HTTP/1.0\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, reader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+
+	// Test: Keep-alive is honoured and announced
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader = bufio.NewReader(conn2)
+
+	_, err = conn2.Write([]byte("GET /small HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+	assert.False(t, resp.Close)
+
+	// Test: Large body isn't chunked but ends with the connection
+	_, err = conn2.Write([]byte("GET /large HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, resp.TransferEncoding)
+	assert.Equal(t, int64(-1), resp.ContentLength)
+	assert.Equal(t, 10000, len(body))
+	assert.True(t, resp.Close)
+}
+
+func TestExpectContinue(t *testing.T) {
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		if req.URL.Path == "/reject" {
+			w.WriteHeader(response.StatusExpectationFailed)
+			return
+		}
+		body, err := req.ReadBody()
+		if err != nil {
+			return
+		}
+		w.Write(body)
+	}, Options{Limits: request.Limits{MaxBodySize: 10}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Test: 100 Continue is sent once the handler reads the body
+	_, err = conn.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", string(body))
+	assert.False(t, resp.Close)
+
+	// Test: Handler rejects without reading, and the connection is closed
+	_, err = conn.Write([]byte("POST /reject HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n"))
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 417 Expectation Failed\r\n", line)
+	resp, err = http.ReadResponse(bufio.NewReader(io.MultiReader(strings.NewReader(line), reader)), nil)
+	require.NoError(t, err)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+
+	// Test: Body over the limit is refused before it is asked for
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader = bufio.NewReader(conn2)
+
+	_, err = conn2.Write([]byte("POST / HTTP/1.1\r\nHost: localhost\r\nExpect: 100-continue\r\nContent-Length: 100\r\n\r\n"))
+	require.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 413 Content Too Large\r\n", line)
+}
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(w *response.Writer, req *request.Request) {
+				order = append(order, name+" before")
+				next(w, req)
+				order = append(order, name+" after")
+			}
+		}
+	}
+
+	// Test: First middleware is the outermost
+	handler := Chain(func(w *response.Writer, req *request.Request) {
+		order = append(order, "handler")
+	}, trace("a"), trace("b"))
+	handler(response.MakeWriter(io.Discard), nil)
+	assert.Equal(t, []string{"a before", "b before", "handler", "b after", "a after"}, order)
+
+	// Test: Chain without middleware returns the handler
+	order = nil
+	Chain(func(w *response.Writer, req *request.Request) { order = append(order, "handler") })(nil, nil)
+	assert.Equal(t, []string{"handler"}, order)
+
+	// Test: Middleware sees the status and size of the response
+	type observed struct {
+		status  response.StatusCode
+		written int
+	}
+	results := make(chan observed, 2)
+	observe := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			next(w, req)
+			results <- observed{w.Status(), w.BytesWritten()}
+		}
+	}
+	auth := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			if _, ok := req.Headers.Get("Authorization"); !ok {
+				w.WriteHeader(response.StatusUnauthorized)
+				w.Write([]byte("no"))
+				return
+			}
+			next(w, req)
+		}
+	}
+
+	s, err := ServeWithOptions(0, Chain(func(w *response.Writer, req *request.Request) {
+		w.Write([]byte("hello"))
+	}, observe, auth), Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, reader)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, observed{response.StatusUnauthorized, 2}, <-results)
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nAuthorization: yes\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, observed{response.StatusOK, 5}, <-results)
+
+	// Test: Middleware can transform the body
+	compress := func(next Handler) Handler {
+		return func(w *response.Writer, req *request.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WrapBody(func(body io.Writer) io.WriteCloser { return gzip.NewWriter(body) })
+			next(w, req)
+		}
+	}
+	s2, err := ServeWithOptions(0, Chain(func(w *response.Writer, req *request.Request) {
+		switch req.URL.Path {
+		case "/empty":
+			w.WriteHeader(response.StatusNoContent)
+		case "/broken":
+			w.WrapBody(func(body io.Writer) io.WriteCloser { return failingCloser{body} })
+			w.Write([]byte("hello"))
+		default:
+			w.Header().Set("Content-Length", "5000")
+			w.Write([]byte(strings.Repeat("hello", 1000)))
+		}
+	}, compress), Options{})
+	require.NoError(t, err)
+	defer s2.Close()
+
+	conn2, err := net.Dial("tcp", s2.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader2 := bufio.NewReader(conn2)
+	_, err = conn2.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Less(t, resp.ContentLength, int64(5000))
+	unzipped, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(unzipped)
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("hello", 1000), string(body))
+
+	// Test: Responses without a body discard what the middleware writes
+	_, err = conn2.Write([]byte("GET /empty HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader2)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.False(t, resp.Close)
+
+	// Test: Response that fails to finish before it is sent becomes a 500
+	_, err = conn2.Write([]byte("GET /broken HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, reader2)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assertClosed(t, reader2)
+}
+
+// failingCloser is a WrapBody writer that can't flush what it was given.
+type failingCloser struct {
+	io.Writer
+}
+
+func (failingCloser) Close() error {
+	return errors.New("flush failed")
+}
+
+func TestVirtualHosts(t *testing.T) {
+	hosts := NewVirtualHosts()
+	hosts.Handle("example.com", named("example"))
+	hosts.Handle("*.example.com", named("subdomain"))
+	hosts.Handle("*.api.example.com", named("api"))
+	hosts.Handle("other.org", named("other"))
+
+	serve := func(raw string) string {
+		req, err := request.RequestFromReader(strings.NewReader(raw))
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		w := response.MakeWriter(&buf)
+		hosts.ServeRequest(w, req)
+		require.NoError(t, w.Finish())
+		return buf.String()
+	}
+
+	// Test: Exact host name, ignoring the port, case and a trailing dot
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "\r\n\r\nexample")
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: Example.COM.:8080\r\n\r\n"), "\r\n\r\nexample")
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: other.org\r\n\r\n"), "\r\n\r\nother")
+
+	// Test: Wildcards match subdomains at any depth, the closest one winning
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"), "\r\n\r\nsubdomain")
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: a.b.example.com\r\n\r\n"), "\r\n\r\nsubdomain")
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: v1.api.example.com\r\n\r\n"), "\r\n\r\napi")
+
+	// Test: Absolute-form target picks the host over the Host header
+	assert.Contains(t, serve("GET http://other.org/ HTTP/1.1\r\nHost: example.com\r\n\r\n"), "\r\n\r\nother")
+
+	// Test: Unknown hosts are misdirected without a default
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: unknown.net\r\n\r\n"), "HTTP/1.1 421 Misdirected Request")
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: www.other.org\r\n\r\n"), "HTTP/1.1 421 Misdirected Request")
+
+	// Test: Default handler serves unknown hosts and requests without one
+	hosts.Handle("*", named("default"))
+	assert.Contains(t, serve("GET / HTTP/1.1\r\nHost: unknown.net\r\n\r\n"), "\r\n\r\ndefault")
+	assert.Contains(t, serve("GET / HTTP/1.0\r\n\r\n"), "\r\n\r\ndefault")
+
+	// Test: Invalid and duplicate patterns
+	assert.Panics(t, func() { hosts.Handle("", named("")) })
+	assert.Panics(t, func() { hosts.Handle("example.com:80", named("")) })
+	assert.Panics(t, func() { hosts.Handle("www.*.com", named("")) })
+	assert.Panics(t, func() { hosts.Handle("EXAMPLE.com", named("")) })
+	assert.Panics(t, func() { hosts.Handle("*.example.com", named("")) })
+	assert.Panics(t, func() { hosts.Handle("*", named("")) })
+}
+
+func TestHostValidation(t *testing.T) {
+	s, err := ServeWithOptions(0, okHandler, Options{})
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a.com, b.com\r\n\r\n",
+	} {
+		// Test: Missing, duplicate or invalid Host is a 400
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+
+		_, err = conn.Write([]byte(raw))
+		require.NoError(t, err)
+		resp := readResponse(t, reader)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, raw)
+		assertClosed(t, reader)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	reported := make(chan any, 2)
+	s, err := ServeWithOptions(0, func(w *response.Writer, req *request.Request) {
+		switch req.RequestLine.RequestTarget {
+		case "/panic":
+			panic("boom")
+		case "/late":
+			w.Write([]byte(strings.Repeat("a", 10000)))
+			panic("late boom")
+		}
+		w.Write([]byte("ok"))
+	}, Options{OnPanic: func(recovered any, stack []byte) {
+		assert.Contains(t, string(stack), "TestPanicRecovery")
+		reported <- recovered
+	}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Test: Panic before the response is started is answered with a 500
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp := readResponse(t, reader)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.True(t, resp.Close)
+	assertClosed(t, reader)
+	assert.Equal(t, "boom", <-reported)
+
+	// Test: Panic after the response is started closes the connection
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	reader2 := bufio.NewReader(conn2)
+
+	_, err = conn2.Write([]byte("GET /late HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err = http.ReadResponse(reader2, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err = io.ReadAll(resp.Body)
+	assert.Error(t, err)
+	assert.Equal(t, "late boom", <-reported)
+
+	// Test: Server keeps serving other connections
+	assert.Contains(t, sendRequest(t, s.Addr().String()), "HTTP/1.1 200 OK")
+}
+
+func TestAccessLog(t *testing.T) {
+	lines := make(chan string, 10)
+	start := time.Now()
+	handler := func(w *response.Writer, req *request.Request) {
+		if req.RequestLine.RequestTarget == "/panic" {
+			panic("boom")
+		}
+		w.WriteHeader(response.StatusCreated)
+		w.Write([]byte("hello"))
+	}
+
+	// Test: Combined Log Format line per request
+	s, err := ServeWithOptions(0, handler, Options{AccessLog: NewAccessLogger(lineWriter(lines), CombinedLogFormat)})
+	require.NoError(t, err)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	_, err = conn.Write([]byte("GET /a?b=c HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test \"agent\"\r\n\r\n"))
+	require.NoError(t, err)
+	readResponse(t, reader)
+	assert.Regexp(t, `^[\d.:a-f]+ - - \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "GET /a\?b=c HTTP/1\.1" 201 5 "-" "test \\"agent\\""\n$`, <-lines)
+
+	// Test: HEAD logs no bytes sent
+	_, err = conn.Write([]byte("HEAD / HTTP/1.1\r\nHost: localhost\r\nReferer: http://example.com/\r\n\r\n"))
+	require.NoError(t, err)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "HEAD"})
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Regexp(t, `"HEAD / HTTP/1\.1" 201 - "http://example\.com/" "-"\n$`, <-lines)
+
+	// Test: Panics are logged with the 500 that was sent
+	_, err = conn.Write([]byte("GET /panic HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	require.NoError(t, err)
+	readResponse(t, reader)
+	assert.Regexp(t, `"GET /panic HTTP/1\.1" 500 21 "-" "-"\n$`, <-lines)
+
+	// Test: Requests that fail to parse are logged with what was parsed
+	conn2, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn2.Close()
+	_, err = conn2.Write([]byte("GET /bad HTTP/1.1\r\nHost: localhost\r\nUser-Agent: test\r\nBad Header\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, bufio.NewReader(conn2))
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Regexp(t, `^[\d.:a-f]+ - - \[[^\]]+\] "GET /bad HTTP/1\.1" 400 \d+ "-" "test"\n$`, <-lines)
+
+	conn3, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn3.Close()
+	_, err = conn3.Write([]byte("GET / HTTP/9.9\r\n\r\n"))
+	require.NoError(t, err)
+	resp = readResponse(t, bufio.NewReader(conn3))
+	assert.Equal(t, http.StatusHTTPVersionNotSupported, resp.StatusCode)
+	assert.Regexp(t, `^[\d.:a-f]+ - - \[[^\]]+\] "-" 505 \d+ "-" "-"\n$`, <-lines)
+
+	// Test: Common Log Format has no referer or user agent
+	s2, err := ServeWithOptions(0, handler, Options{AccessLog: NewAccessLogger(lineWriter(lines), CommonLogFormat)})
+	require.NoError(t, err)
+	defer s2.Close()
+	sendRequest(t, s2.Addr().String())
+	assert.Regexp(t, `\] "GET / HTTP/1\.1" 201 5\n$`, <-lines)
+
+	// Test: JSON entries carry every field
+	s3, err := ServeWithOptions(0, handler, Options{AccessLog: NewAccessLogger(lineWriter(lines), JSONLogFormat)})
+	require.NoError(t, err)
+	defer s3.Close()
+	sendRequest(t, s3.Addr().String())
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(<-lines), &entry))
+	assert.Equal(t, "request", entry["msg"])
+	_, port, err := net.SplitHostPort(entry["remote_addr"].(string))
+	require.NoError(t, err)
+	assert.NotEmpty(t, port)
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/", entry["target"])
+	assert.Equal(t, "HTTP/1.1", entry["version"])
+	assert.Equal(t, float64(201), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.Equal(t, "", entry["user_agent"])
+	assert.GreaterOrEqual(t, entry["duration"], float64(0))
+	logged, err := time.Parse(time.RFC3339Nano, entry["time"].(string))
+	require.NoError(t, err)
+	assert.False(t, logged.Before(start))
+}
+
+// lineWriter sends everything written to it on lines, so log output can be
+// read safely from the test goroutine.
+type lineWriter chan string
+
+func (l lineWriter) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func okHandler(w *response.Writer, req *request.Request) {
+	body := []byte("ok")
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+// named returns a handler writing name as the body.
+func named(name string) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		w.Write([]byte(name))
+	}
+}
+
+func echoHandler(w *response.Writer, req *request.Request) {
+	body, err := req.ReadBody()
+	if err != nil {
+		return
+	}
+	w.WriteStatusLine(response.StatusOK)
+	w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+	w.WriteBody(body)
+}
+
+func readResponse(t *testing.T, reader *bufio.Reader) *http.Response {
+	t.Helper()
+	resp, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func assertClosed(t *testing.T, reader *bufio.Reader) {
+	t.Helper()
+	_, err := reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func blockingHandler(entered chan<- struct{}, release <-chan struct{}) Handler {
+	return func(w *response.Writer, req *request.Request) {
+		entered <- struct{}{}
+		<-release
+
+		body := []byte("ok")
+		w.WriteStatusLine(response.StatusOK)
+		w.WriteHeaders(response.GetDefaultHeaders(len(body)))
+		w.WriteBody(body)
+	}
+}
+
+func sendRequest(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Errorf("error dialing server: %v", err)
+		return ""
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n"))
+	if err != nil {
+		t.Errorf("error writing request: %v", err)
+		return ""
+	}
+
+	resp, _ := io.ReadAll(conn)
+	return string(resp)
+}
+
+func waitFor(t *testing.T, ch <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for handler")
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"httpfromtcp/internal/request"
+	"httpfromtcp/internal/response"
+)
+
+// VirtualHosts dispatches requests to a Handler chosen by the host name they
+// are for, so several sites can be served on one port. Requests for a host no
+// pattern matches get a 421.
+type VirtualHosts struct {
+	hosts map[string]Handler
+	// wildcards are keyed by the domain their subdomains are under
+	wildcards map[string]Handler
+	fallback  Handler
+}
+
+func NewVirtualHosts() *VirtualHosts {
+	return &VirtualHosts{
+		hosts:     make(map[string]Handler),
+		wildcards: make(map[string]Handler),
+	}
+}
+
+// Handle registers handler for requests whose host matches pattern. A pattern
+// is a host name such as "example.com", "*.example.com" for any of its
+// subdomains at any depth, or "*" for any host, including none. Host names are
+// matched without regard to case, an exact name wins over a wildcard, and a
+// longer wildcard over a shorter one. Handle panics if the pattern is invalid
+// or already registered.
+func (v *VirtualHosts) Handle(pattern string, handler Handler) {
+	if pattern == "*" {
+		if v.fallback != nil {
+			panic(fmt.Sprintf("server: host pattern %q registered twice", pattern))
+		}
+		v.fallback = handler
+		return
+	}
+
+	hosts := v.hosts
+	name := pattern
+	if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+		hosts, name = v.wildcards, domain
+	}
+	name = normalizeHost(name)
+	if name == "" || (strings.ContainsAny(name, "*/: \t") && !strings.HasPrefix(name, "[")) {
+		panic(fmt.Sprintf("server: invalid host pattern %q", pattern))
+	}
+	if _, ok := hosts[name]; ok {
+		panic(fmt.Sprintf("server: host pattern %q registered twice", pattern))
+	}
+	hosts[name] = handler
+}
+
+// ServeRequest is a Handler that dispatches req to the handler for its host.
+func (v *VirtualHosts) ServeRequest(w *response.Writer, req *request.Request) {
+	if handler := v.match(normalizeHost(req.Host())); handler != nil {
+		handler(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(response.StatusMisdirectedRequest)
+	w.Write([]byte(response.StatusText(response.StatusMisdirectedRequest)))
+}
+
+func (v *VirtualHosts) match(host string) Handler {
+	if handler, ok := v.hosts[host]; ok {
+		return handler
+	}
+	// try the parent domains from the closest one up
+	for domain := host; ; {
+		i := strings.IndexByte(domain, '.')
+		if i == -1 {
+			break
+		}
+		domain = domain[i+1:]
+		if handler, ok := v.wildcards[domain]; ok {
+			return handler
+		}
+	}
+	return v.fallback
+}
+
+// normalizeHost lowercases a host name and drops the trailing dot of a fully
+// qualified one, so "Example.COM." and "example.com" are the same host.
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}